@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// CanonicalItem Struct for an item in its canonical file form
+type CanonicalItem struct {
+	Path string
+	Item map[string]*dynamodb.AttributeValue
+	JSON []byte
+}
+
+func dumpCommand(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	canonical := flags.Bool("canonical", false, "write one sorted JSON file per item")
+	outputDir := flags.String("output", "", "directory to write items to (default: the table name)")
+	boostRead := flags.Int64("boost-read", 0, "read capacity units to provision while scanning, reverted afterwards")
+	flags.Parse(args)
+
+	if !*canonical || flags.NArg() != 1 {
+		log.Fatal("Usage: dynamodb-backups dump --canonical [-output DIR] [-boost-read N] TABLE")
+	}
+	table := flags.Arg(0)
+	if *outputDir == "" {
+		*outputDir = table
+	}
+
+	err := withCapacityBoost(table, capacityRead, *boostRead, func() error {
+		return dumpCanonical(table, *outputDir)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func syncCommand(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	inputDir := flags.String("input", "", "directory of canonical item files (default: the table name)")
+	dryRun := flags.Bool("dry-run", false, "only log the puts and deletes that would be made")
+	allowEmpty := flags.Bool("allow-empty", false, "allow an input directory without items, deleting every item of the table")
+	boostWrite := flags.Int64("boost-write", 0, "write capacity units to provision while loading, reverted afterwards")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: dynamodb-backups sync [-input DIR] [-dry-run] [-allow-empty] [-boost-write N] TABLE")
+	}
+	table := flags.Arg(0)
+	if *inputDir == "" {
+		*inputDir = table
+	}
+
+	if *dryRun {
+		*boostWrite = 0
+	}
+	err := withCapacityBoost(table, capacityWrite, *boostWrite, func() error {
+		return syncCanonical(table, *inputDir, *dryRun, *allowEmpty)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dumpCanonical writes every item of a table to its own file under dir, and
+// removes files of items that no longer exist, so that the directory can be
+// committed to git and diffed
+func dumpCanonical(table string, dir string) error {
+	items, err := scanCanonicalItems(table)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	written := make(map[string]bool, len(items))
+	for _, item := range items {
+		path := filepath.Join(dir, item.Path)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(path, item.JSON, 0644)
+		if err != nil {
+			return err
+		}
+		written[path] = true
+	}
+
+	keySchema, err := getKeySchema(table)
+	if err != nil {
+		return err
+	}
+
+	// only files that are items of this table are removed, so that dumping
+	// into a directory shared with other files leaves them alone
+	removed := 0
+	err = walkCanonicalItemFiles(dir, func(path string) error {
+		if written[path] || readCanonicalItemFile(dir, path, keySchema) == nil {
+			return nil
+		}
+		removed++
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"table":   table,
+		"path":    dir,
+		"count":   len(items),
+		"removed": removed,
+	}).Info(fmt.Sprintf("Dumped %d items from table %s", len(items), table))
+
+	return nil
+}
+
+// readCanonicalItemFile returns the item held by the file at path, or nil if
+// it is not an item of a table with keySchema stored at the path
+// dumpCanonical would write it to
+func readCanonicalItemFile(dir string, path string, keySchema []string) *CanonicalItem {
+	relativePath, err := filepath.Rel(dir, path)
+	if err != nil || filepath.Ext(path) != ".json" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	item, err := parseCanonicalItem(data)
+	if err != nil {
+		return nil
+	}
+	canonicalItem, err := newCanonicalItem(item, keySchema)
+	if err != nil || canonicalItem.Path != relativePath {
+		return nil
+	}
+	return canonicalItem
+}
+
+// walkCanonicalItemFiles calls fn for every file below dir that is not in a
+// hidden directory, such as .git
+func walkCanonicalItemFiles(dir string, fn func(path string) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// syncCanonical applies a directory of canonical item files to a table with
+// the minimal set of puts and deletes. Files that are not items of the table
+// are skipped, as dumpCanonical leaves them alone. An empty directory would
+// delete every item, so it is refused unless allowEmpty is set.
+func syncCanonical(table string, dir string, dryRun bool, allowEmpty bool) error {
+	keySchema, err := getKeySchema(table)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]*CanonicalItem)
+	skipped := 0
+	err = walkCanonicalItemFiles(dir, func(path string) error {
+		canonicalItem := readCanonicalItemFile(dir, path, keySchema)
+		if canonicalItem == nil {
+			skipped++
+			log.WithFields(logrus.Fields{
+				"table": table,
+				"path":  path,
+			}).Debug("Skipping file that is not an item of the table")
+			return nil
+		}
+		wanted[canonicalItem.Path] = canonicalItem
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(wanted) == 0 && !allowEmpty {
+		return fmt.Errorf("no item files found in %s, refusing to delete every item of table %s without -allow-empty", dir, table)
+	}
+
+	current, err := scanCanonicalItems(table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*CanonicalItem, len(current))
+	for _, item := range current {
+		existing[item.Path] = item
+	}
+
+	localLogger := log.WithFields(logrus.Fields{
+		"table":  table,
+		"action": "syncCanonical",
+		"dryRun": dryRun,
+	})
+
+	puts, deletes := 0, 0
+	for path, item := range wanted {
+		if existingItem, ok := existing[path]; ok && bytes.Equal(existingItem.JSON, item.JSON) {
+			continue
+		}
+		puts++
+		localLogger.WithFields(logrus.Fields{"item": path}).Info("Putting item")
+		if dryRun {
+			continue
+		}
+		_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+			TableName: &table,
+			Item:      item.Item,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for path, item := range existing {
+		if _, ok := wanted[path]; ok {
+			continue
+		}
+		deletes++
+		localLogger.WithFields(logrus.Fields{"item": path}).Info("Deleting item")
+		if dryRun {
+			continue
+		}
+		_, err = dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: &table,
+			Key:       itemKey(item.Item, keySchema),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	localLogger.WithFields(logrus.Fields{
+		"puts":    puts,
+		"deletes": deletes,
+		"skipped": skipped,
+	}).Info(fmt.Sprintf("Synced table %s: %d puts, %d deletes", table, puts, deletes))
+
+	return nil
+}
+
+// scanCanonicalItems reads every item of a table in canonical form
+func scanCanonicalItems(table string) ([]*CanonicalItem, error) {
+	keySchema, err := getKeySchema(table)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*CanonicalItem, 0)
+	var itemErr error
+	err = dynamo.ScanPages(&dynamodb.ScanInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			canonicalItem, err := newCanonicalItem(item, keySchema)
+			if err != nil {
+				itemErr = err
+				return false
+			}
+			items = append(items, canonicalItem)
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return items, itemErr
+}
+
+// getKeySchema returns the key attribute names of a table, partition key first
+func getKeySchema(table string) ([]string, error) {
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keySchema := make([]string, 0, 2)
+	for _, element := range describeTableOutput.Table.KeySchema {
+		if *element.KeyType == dynamodb.KeyTypeHash {
+			keySchema = append([]string{*element.AttributeName}, keySchema...)
+		} else {
+			keySchema = append(keySchema, *element.AttributeName)
+		}
+	}
+	return keySchema, nil
+}
+
+func newCanonicalItem(item map[string]*dynamodb.AttributeValue, keySchema []string) (*CanonicalItem, error) {
+	segments := make([]string, 0, len(keySchema))
+	for _, name := range keySchema {
+		value, ok := item[name]
+		if !ok {
+			return nil, fmt.Errorf("item is missing key attribute %s", name)
+		}
+		segments = append(segments, keyPathSegment(value))
+	}
+
+	data, err := formatCanonicalItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CanonicalItem{
+		Path: filepath.Join(segments...) + ".json",
+		Item: item,
+		JSON: data,
+	}, nil
+}
+
+func itemKey(item map[string]*dynamodb.AttributeValue, keySchema []string) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue, len(keySchema))
+	for _, name := range keySchema {
+		key[name] = item[name]
+	}
+	return key
+}
+
+// keyPathSegment turns a key value into a file name safe on every platform
+func keyPathSegment(value *dynamodb.AttributeValue) string {
+	var raw string
+	switch {
+	case value.S != nil:
+		raw = *value.S
+	case value.N != nil:
+		raw = *value.N
+	default:
+		raw = base64.RawURLEncoding.EncodeToString(value.B)
+	}
+
+	// PathEscape leaves colons alone, which Windows does not allow
+	segment := strings.Replace(url.PathEscape(raw), ":", "%3A", -1)
+	if strings.HasPrefix(segment, ".") {
+		segment = "%2E" + segment[1:]
+	}
+	return segment
+}
+
+// formatCanonicalItem encodes an item as pretty-printed DynamoDB JSON with
+// sorted attribute names and set members, ending in a newline
+func formatCanonicalItem(item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	encoded := make(map[string]interface{}, len(item))
+	for name, value := range item {
+		encoded[name] = canonicalValue(value)
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(encoded)
+	return buffer.Bytes(), err
+}
+
+func canonicalValue(value *dynamodb.AttributeValue) map[string]interface{} {
+	switch {
+	case value.S != nil:
+		return map[string]interface{}{"S": *value.S}
+	case value.N != nil:
+		return map[string]interface{}{"N": *value.N}
+	case value.B != nil:
+		return map[string]interface{}{"B": base64.StdEncoding.EncodeToString(value.B)}
+	case value.BOOL != nil:
+		return map[string]interface{}{"BOOL": *value.BOOL}
+	case value.NULL != nil:
+		return map[string]interface{}{"NULL": true}
+	case value.SS != nil:
+		members := aws.StringValueSlice(value.SS)
+		sort.Strings(members)
+		return map[string]interface{}{"SS": members}
+	case value.NS != nil:
+		members := aws.StringValueSlice(value.NS)
+		sort.Strings(members)
+		return map[string]interface{}{"NS": members}
+	case value.BS != nil:
+		members := make([]string, 0, len(value.BS))
+		for _, member := range value.BS {
+			members = append(members, base64.StdEncoding.EncodeToString(member))
+		}
+		sort.Strings(members)
+		return map[string]interface{}{"BS": members}
+	case value.M != nil:
+		members := make(map[string]interface{}, len(value.M))
+		for name, member := range value.M {
+			members[name] = canonicalValue(member)
+		}
+		return map[string]interface{}{"M": members}
+	default:
+		members := make([]interface{}, 0, len(value.L))
+		for _, member := range value.L {
+			members = append(members, canonicalValue(member))
+		}
+		return map[string]interface{}{"L": members}
+	}
+}
+
+// parseCanonicalItem decodes an item written by formatCanonicalItem
+func parseCanonicalItem(data []byte) (map[string]*dynamodb.AttributeValue, error) {
+	var encoded map[string]json.RawMessage
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	item := make(map[string]*dynamodb.AttributeValue, len(encoded))
+	for name, raw := range encoded {
+		item[name], err = parseCanonicalValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %s", name, err)
+		}
+	}
+	return item, nil
+}
+
+func parseCanonicalValue(raw json.RawMessage) (*dynamodb.AttributeValue, error) {
+	var encoded map[string]json.RawMessage
+	err := json.Unmarshal(raw, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) != 1 {
+		return nil, fmt.Errorf("expected a single type key, got %d", len(encoded))
+	}
+
+	value := &dynamodb.AttributeValue{}
+	for dataType, data := range encoded {
+		switch dataType {
+		case "S":
+			err = json.Unmarshal(data, &value.S)
+		case "N":
+			err = json.Unmarshal(data, &value.N)
+		case "B":
+			err = json.Unmarshal(data, &value.B)
+		case "BOOL":
+			err = json.Unmarshal(data, &value.BOOL)
+		case "NULL":
+			value.NULL = aws.Bool(true)
+		case "SS":
+			err = json.Unmarshal(data, &value.SS)
+		case "NS":
+			err = json.Unmarshal(data, &value.NS)
+		case "BS":
+			err = json.Unmarshal(data, &value.BS)
+		case "M":
+			var members map[string]json.RawMessage
+			err = json.Unmarshal(data, &members)
+			value.M = make(map[string]*dynamodb.AttributeValue, len(members))
+			for name, member := range members {
+				if err != nil {
+					break
+				}
+				value.M[name], err = parseCanonicalValue(member)
+			}
+		case "L":
+			var members []json.RawMessage
+			err = json.Unmarshal(data, &members)
+			value.L = make([]*dynamodb.AttributeValue, 0, len(members))
+			for _, member := range members {
+				if err != nil {
+					break
+				}
+				var parsed *dynamodb.AttributeValue
+				parsed, err = parseCanonicalValue(member)
+				value.L = append(value.L, parsed)
+			}
+		default:
+			err = fmt.Errorf("unknown type %s", dataType)
+		}
+	}
+	return value, err
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// Capacity dimensions that can be boosted
+const (
+	capacityRead  = "read"
+	capacityWrite = "write"
+)
+
+// tag recording the capacity to revert a boosted table to
+const capacityRestoreTag = "dynamodb-backups:capacity-restore"
+
+// DynamoDB always allows this many decreases per day; further decreases are
+// only allowed once an hour has passed without one. A boost is skipped when
+// its revert could be held up by that limit.
+const capacityFreeDecreases = 4
+
+// A restore point is owned by the run that boosted the table for this long,
+// and the owner renews it every capacityHeartbeatInterval. Once it has
+// expired, the owner is taken to be gone and the boost may be reverted.
+const (
+	capacityLeaseDuration     = 10 * time.Minute
+	capacityHeartbeatInterval = 2 * time.Minute
+)
+
+// CapacityRestorePoint Struct recording the capacity a boosted table had. Min
+// and MaxCapacity are zero when the dimension has no auto scaling target.
+// Owner is the process that boosted the table, and Expires when its lease
+// on the boost runs out.
+type CapacityRestorePoint struct {
+	Dimension   string
+	Capacity    int64
+	MinCapacity int64
+	MaxCapacity int64
+	Owner       string
+	Expires     time.Time
+}
+
+func (restorePoint *CapacityRestorePoint) String() string {
+	return fmt.Sprintf("%s=%d min=%d max=%d owner=%s expires=%d",
+		restorePoint.Dimension, restorePoint.Capacity, restorePoint.MinCapacity, restorePoint.MaxCapacity,
+		restorePoint.Owner, restorePoint.Expires.Unix())
+}
+
+// isStale reports whether the owner of a restore point stopped renewing it
+func (restorePoint *CapacityRestorePoint) isStale(now time.Time) bool {
+	return !now.Before(restorePoint.Expires)
+}
+
+func parseCapacityRestorePoint(value string) (*CapacityRestorePoint, error) {
+	restorePoint := &CapacityRestorePoint{}
+	for _, field := range strings.Fields(value) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid capacity restore point %q", value)
+		}
+		if parts[0] == "owner" {
+			restorePoint.Owner = parts[1]
+			continue
+		}
+		number, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capacity restore point %q", value)
+		}
+
+		switch parts[0] {
+		case capacityRead, capacityWrite:
+			restorePoint.Dimension = parts[0]
+			restorePoint.Capacity = number
+		case "min":
+			restorePoint.MinCapacity = number
+		case "max":
+			restorePoint.MaxCapacity = number
+		case "expires":
+			restorePoint.Expires = time.Unix(number, 0).UTC()
+		}
+	}
+	if restorePoint.Dimension == "" {
+		return nil, fmt.Errorf("invalid capacity restore point %q", value)
+	}
+	return restorePoint, nil
+}
+
+// capacityOwner identifies this process as the owner of a restore point
+func capacityOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func capacityCommand(args []string) {
+	if len(args) < 1 || args[0] != "restore" {
+		log.Fatal("Usage: dynamodb-backups capacity restore [-force] TABLE...")
+	}
+
+	flags := flag.NewFlagSet("capacity restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "also revert boosts whose owner is still renewing them")
+	flags.Parse(args[1:])
+
+	if flags.NArg() == 0 {
+		log.Fatal("Usage: dynamodb-backups capacity restore [-force] TABLE...")
+	}
+
+	owner := capacityOwner()
+	if *force {
+		owner = ""
+	}
+	for _, table := range flags.Args() {
+		err := restoreCapacity(table, owner)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"table":  table,
+				"action": "restoreCapacity",
+			}).Error(err)
+		}
+	}
+}
+
+// withCapacityBoost raises the provisioned capacity of a table for the
+// duration of fn, and reverts it afterwards, including when boosting or fn
+// fails or the process is interrupted. A target of 0 runs fn without a boost.
+func withCapacityBoost(table string, dimension string, target int64, fn func() error) error {
+	if target <= 0 {
+		return fn()
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupted:
+			log.WithFields(logrus.Fields{
+				"table": table,
+			}).Warn("Interrupted, reverting capacity boost")
+			err := restoreCapacity(table, capacityOwner())
+			if err != nil {
+				log.Error(err)
+			}
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	// a failed boost may already have recorded a restore point and raised
+	// the auto scaling minimum, so it is reverted as well
+	restorePoint, tableArn, err := boostCapacity(table, dimension, target)
+	if err == nil {
+		if restorePoint != nil {
+			go renewCapacityRestorePoint(table, tableArn, restorePoint, done)
+		}
+		err = fn()
+	}
+
+	signal.Stop(interrupted)
+	close(done)
+
+	if restorePoint != nil {
+		restoreErr := restoreCapacity(table, capacityOwner())
+		if err == nil {
+			return restoreErr
+		}
+		if restoreErr != nil {
+			log.WithFields(logrus.Fields{
+				"table":  table,
+				"action": "restoreCapacity",
+			}).Error(restoreErr)
+		}
+	}
+	return err
+}
+
+// renewCapacityRestorePoint extends the lease on a restore point until done
+// is closed, so that other runs do not take the boost for an abandoned one
+func renewCapacityRestorePoint(table string, tableArn *string, restorePoint *CapacityRestorePoint, done chan struct{}) {
+	ticker := time.NewTicker(capacityHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		renewed := *restorePoint
+		renewed.Expires = time.Now().UTC().Add(capacityLeaseDuration)
+		err := tagCapacityRestorePoint(tableArn, &renewed)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"table":  table,
+				"action": "renewCapacityRestorePoint",
+			}).Warn(fmt.Sprintf("Could not renew capacity restore point: %s", err))
+		}
+	}
+}
+
+// boostCapacity raises one capacity dimension of a provisioned table to
+// target, recording a restore point on the table first. It returns the
+// restore point it recorded and the table ARN, or a nil restore point if no
+// boost was needed or it was skipped. A table boosted by another run that is
+// still renewing its restore point is refused.
+func boostCapacity(table string, dimension string, target int64) (*CapacityRestorePoint, *string, error) {
+	localLogger := log.WithFields(logrus.Fields{
+		"table":     table,
+		"dimension": dimension,
+		"target":    target,
+		"action":    "boostCapacity",
+	})
+
+	// revert a boost left behind by a run that was killed first
+	err := restoreCapacity(table, capacityOwner())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	tableDescription := describeTableOutput.Table
+
+	if tableDescription.BillingModeSummary != nil &&
+		aws.StringValue(tableDescription.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		localLogger.Info("Table is on-demand, not boosting capacity")
+		return nil, nil, nil
+	}
+
+	throughput := tableDescription.ProvisionedThroughput
+	readCapacity := aws.Int64Value(throughput.ReadCapacityUnits)
+	writeCapacity := aws.Int64Value(throughput.WriteCapacityUnits)
+	current := readCapacity
+	if dimension == capacityWrite {
+		current = writeCapacity
+	}
+
+	if target <= current {
+		localLogger.Info(fmt.Sprintf("Table already has %d %s capacity units, not boosting", current, dimension))
+		return nil, nil, nil
+	}
+	if aws.Int64Value(throughput.NumberOfDecreasesToday) >= capacityFreeDecreases {
+		localLogger.Warn(fmt.Sprintf("Table was decreased %d times today, reverting a boost could be delayed, not boosting",
+			aws.Int64Value(throughput.NumberOfDecreasesToday)))
+		return nil, nil, nil
+	}
+
+	restorePoint := &CapacityRestorePoint{
+		Dimension: dimension,
+		Capacity:  current,
+		Owner:     capacityOwner(),
+		Expires:   time.Now().UTC().Add(capacityLeaseDuration),
+	}
+	scalableTarget, err := getScalableTarget(table, dimension)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scalableTarget != nil {
+		restorePoint.MinCapacity = aws.Int64Value(scalableTarget.MinCapacity)
+		restorePoint.MaxCapacity = aws.Int64Value(scalableTarget.MaxCapacity)
+	}
+
+	tableArn := tableDescription.TableArn
+	err = tagCapacityRestorePoint(tableArn, restorePoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// tags cannot be written conditionally, so a run that boosts the table
+	// at the same time is detected by reading the restore point back; the
+	// last writer boosts and the others back off before changing anything
+	recorded, err := getCapacityRestorePoint(tableArn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if recorded == nil || recorded.Owner != restorePoint.Owner {
+		return nil, nil, fmt.Errorf("table %s is being boosted by another run", table)
+	}
+
+	// keep auto scaling from scaling the boost straight back down
+	if scalableTarget != nil {
+		maxCapacity := restorePoint.MaxCapacity
+		if target > maxCapacity {
+			maxCapacity = target
+		}
+		err = registerScalableTarget(table, dimension, target, maxCapacity)
+		if err != nil {
+			return restorePoint, tableArn, err
+		}
+	}
+
+	if dimension == capacityRead {
+		readCapacity = target
+	} else {
+		writeCapacity = target
+	}
+	err = updateProvisionedThroughput(table, readCapacity, writeCapacity)
+	if err != nil {
+		return restorePoint, tableArn, err
+	}
+
+	localLogger.WithFields(logrus.Fields{
+		"restorePoint": restorePoint.String(),
+	}).Info(fmt.Sprintf("Boosted %s capacity of table %s from %d to %d", dimension, table, restorePoint.Capacity, target))
+
+	return restorePoint, tableArn, nil
+}
+
+// restoreCapacity reverts a table to its recorded restore point, if it has
+// one, and removes the restore point once the table is back. A restore point
+// is only reverted when owner recorded it, when its owner stopped renewing
+// it, or when owner is empty.
+func restoreCapacity(table string, owner string) error {
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return err
+	}
+	tableDescription := describeTableOutput.Table
+
+	restorePoint, err := getCapacityRestorePoint(tableDescription.TableArn)
+	if err != nil {
+		return err
+	}
+	if restorePoint == nil {
+		return nil
+	}
+	if owner != "" && restorePoint.Owner != owner && !restorePoint.isStale(time.Now()) {
+		return fmt.Errorf("table %s is boosted by %s until at least %s, not reverting",
+			table, restorePoint.Owner, restorePoint.Expires.Format(time.RFC3339))
+	}
+
+	if restorePoint.MaxCapacity > 0 {
+		err = registerScalableTarget(table, restorePoint.Dimension, restorePoint.MinCapacity, restorePoint.MaxCapacity)
+		if err != nil {
+			return err
+		}
+	}
+
+	throughput := tableDescription.ProvisionedThroughput
+	readCapacity := aws.Int64Value(throughput.ReadCapacityUnits)
+	writeCapacity := aws.Int64Value(throughput.WriteCapacityUnits)
+	current := readCapacity
+	if restorePoint.Dimension == capacityRead {
+		readCapacity = restorePoint.Capacity
+	} else {
+		current = writeCapacity
+		writeCapacity = restorePoint.Capacity
+	}
+
+	if current != restorePoint.Capacity {
+		err = updateProvisionedThroughput(table, readCapacity, writeCapacity)
+		if err != nil {
+			return fmt.Errorf("could not revert capacity of table %s to %s, run `capacity restore %s` later: %s",
+				table, restorePoint.String(), table, err)
+		}
+	}
+
+	<-tagResourceThrottle
+	_, err = dynamo.UntagResource(&dynamodb.UntagResourceInput{
+		ResourceArn: tableDescription.TableArn,
+		TagKeys:     aws.StringSlice([]string{capacityRestoreTag}),
+	})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"table":        table,
+		"restorePoint": restorePoint.String(),
+		"action":       "restoreCapacity",
+	}).Info(fmt.Sprintf("Reverted %s capacity of table %s to %d", restorePoint.Dimension, table, restorePoint.Capacity))
+
+	return nil
+}
+
+// getCapacityRestorePoint returns the restore point recorded on a table, or
+// nil if it has none
+func getCapacityRestorePoint(tableArn *string) (*CapacityRestorePoint, error) {
+	tags, err := listResourceTags(tableArn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range tags {
+		if *tag.Key == capacityRestoreTag {
+			return parseCapacityRestorePoint(*tag.Value)
+		}
+	}
+	return nil, nil
+}
+
+func tagCapacityRestorePoint(tableArn *string, restorePoint *CapacityRestorePoint) error {
+	<-tagResourceThrottle
+	_, err := dynamo.TagResource(&dynamodb.TagResourceInput{
+		ResourceArn: tableArn,
+		Tags: []*dynamodb.Tag{
+			{Key: aws.String(capacityRestoreTag), Value: aws.String(restorePoint.String())},
+		},
+	})
+	return err
+}
+
+func updateProvisionedThroughput(table string, readCapacity int64, writeCapacity int64) error {
+	_, err := dynamo.UpdateTable(&dynamodb.UpdateTableInput{
+		TableName: &table,
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(readCapacity),
+			WriteCapacityUnits: aws.Int64(writeCapacity),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return dynamo.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+}
+
+func scalableDimension(dimension string) string {
+	if dimension == capacityRead {
+		return applicationautoscaling.ScalableDimensionDynamodbTableReadCapacityUnits
+	}
+	return applicationautoscaling.ScalableDimensionDynamodbTableWriteCapacityUnits
+}
+
+// getScalableTarget returns the auto scaling target of a table dimension, or
+// nil if it is not auto scaled
+func getScalableTarget(table string, dimension string) (*applicationautoscaling.ScalableTarget, error) {
+	describeOutput, err := autoScaling.DescribeScalableTargets(&applicationautoscaling.DescribeScalableTargetsInput{
+		ServiceNamespace:  aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+		ResourceIds:       aws.StringSlice([]string{"table/" + table}),
+		ScalableDimension: aws.String(scalableDimension(dimension)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(describeOutput.ScalableTargets) == 0 {
+		return nil, nil
+	}
+	return describeOutput.ScalableTargets[0], nil
+}
+
+func registerScalableTarget(table string, dimension string, minCapacity int64, maxCapacity int64) error {
+	_, err := autoScaling.RegisterScalableTarget(&applicationautoscaling.RegisterScalableTargetInput{
+		ServiceNamespace:  aws.String(applicationautoscaling.ServiceNamespaceDynamodb),
+		ResourceId:        aws.String("table/" + table),
+		ScalableDimension: aws.String(scalableDimension(dimension)),
+		MinCapacity:       aws.Int64(minCapacity),
+		MaxCapacity:       aws.Int64(maxCapacity),
+	})
+	return err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func configCommand(args []string) {
+	if len(args) != 3 || args[0] != "diff" {
+		log.Fatal("Usage: dynamodb-backups config diff OLD NEW")
+	}
+
+	err := diffConfigFiles(args[1], args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readConfigFile reads KEY=VALUE lines from an environment file. Blank lines,
+// comments, `export` prefixes and quotes around values are allowed.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNum)
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+
+	return values, scanner.Err()
+}
+
+// loadConfigFile parses a Config from an environment file alone. Keys missing
+// from the file take their defaults rather than values from the shell.
+func loadConfigFile(path string) (*Config, error) {
+	values, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadConfig(values)
+}
+
+// diffConfigFiles evaluates two configurations against the live tables and
+// backups, and prints the tables and backups whose treatment would change.
+func diffConfigFiles(oldPath string, newPath string) error {
+	oldConfig, err := loadConfigFile(oldPath)
+	if err != nil {
+		return err
+	}
+	newConfig, err := loadConfigFile(newPath)
+	if err != nil {
+		return err
+	}
+
+	oldRegex, err := regexp.Compile(oldConfig.TableRegex)
+	if err != nil {
+		return fmt.Errorf("%s: invalid TABLE_REGEX: %s", oldPath, err)
+	}
+	newRegex, err := regexp.Compile(newConfig.TableRegex)
+	if err != nil {
+		return fmt.Errorf("%s: invalid TABLE_REGEX: %s", newPath, err)
+	}
+
+	tableNames, err := listTableNames()
+	if err != nil {
+		return err
+	}
+	oldTables := stringSet(matchTables(oldRegex, tableNames))
+	newTables := stringSet(matchTables(newRegex, tableNames))
+
+	included := make([]string, 0)
+	excluded := make([]string, 0)
+	for _, table := range tableNames {
+		if newTables[table] && !oldTables[table] {
+			included = append(included, table)
+		}
+		if oldTables[table] && !newTables[table] {
+			excluded = append(excluded, table)
+		}
+	}
+
+	fmt.Printf("Tables matched: %d -> %d (of %d)\n", len(oldTables), len(newTables), len(tableNames))
+	printTableList("Tables newly included", "+", included)
+	printTableList("Tables newly excluded", "-", excluded)
+
+	fmt.Println()
+	if oldConfig.BackupExpireDays == newConfig.BackupExpireDays &&
+		oldConfig.BackupDeleteGraceDays == newConfig.BackupDeleteGraceDays {
+		fmt.Println("Retention: unchanged")
+	} else {
+		fmt.Println("Retention changes (all tables matched by both):")
+		fmt.Printf("  BACKUP_EXPIRE_DAYS: %d -> %d\n", oldConfig.BackupExpireDays, newConfig.BackupExpireDays)
+		fmt.Printf("  BACKUP_DELETE_GRACE_DAYS: %d -> %d\n", oldConfig.BackupDeleteGraceDays, newConfig.BackupDeleteGraceDays)
+	}
+
+	now := time.Now()
+	var oldCutoff, newCutoff time.Time
+	withConfig(oldConfig, func() { oldCutoff = backupExpireCutoff(now) })
+	withConfig(newConfig, func() { newCutoff = backupExpireCutoff(now) })
+
+	eligible := make([]*dynamodb.BackupSummary, 0)
+	for _, table := range tableNames {
+		if !newTables[table] {
+			continue
+		}
+
+		backups, err := listTableBackups(table)
+		if err != nil {
+			return err
+		}
+
+		for _, backup := range backups {
+			created := aws.TimeValue(backup.BackupCreationDateTime)
+			expiredUnderNew := created.Before(newCutoff)
+			expiredUnderOld := oldTables[table] && created.Before(oldCutoff)
+			if expiredUnderNew && !expiredUnderOld {
+				eligible = append(eligible, backup)
+			}
+		}
+	}
+
+	sort.Slice(eligible, func(i, j int) bool {
+		return eligible[i].BackupCreationDateTime.Before(*eligible[j].BackupCreationDateTime)
+	})
+
+	fmt.Println()
+	fmt.Printf("Backups newly eligible for deletion (%d):\n", len(eligible))
+	for _, backup := range eligible {
+		fmt.Printf("  %s\t%s\t%s\t%s\n",
+			aws.StringValue(backup.TableName),
+			aws.StringValue(backup.BackupName),
+			aws.TimeValue(backup.BackupCreationDateTime).UTC().Format(time.RFC3339),
+			aws.StringValue(backup.BackupArn),
+		)
+	}
+
+	return nil
+}
+
+func printTableList(title string, marker string, tables []string) {
+	fmt.Println()
+	fmt.Printf("%s (%d):\n", title, len(tables))
+	for _, table := range tables {
+		fmt.Printf("  %s %s\n", marker, table)
+	}
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	configTableResourceType = "AWS::DynamoDB::Table"
+
+	// PutEvaluations accepts at most 100 evaluations per call
+	configEvaluationBatchSize = 100
+
+	// Config truncates annotations longer than this
+	configAnnotationMaxLength = 256
+)
+
+// ConfigRuleParameters Struct for the rule parameters set on the Config rule
+type ConfigRuleParameters struct {
+	MaxBackupAgeHours    int
+	RequirePITR          bool
+	MinRetentionDays     int
+	RequireKMSEncryption bool
+}
+
+// ConfigInvokingEvent Struct for the fields of a Config invoking event used
+// by the rule, covering change, oversized change and scheduled notifications.
+// Oversized notifications carry a summary instead of the configuration item.
+type ConfigInvokingEvent struct {
+	MessageType              string                   `json:"messageType"`
+	NotificationCreationTime time.Time                `json:"notificationCreationTime"`
+	ConfigurationItem        *ConfigConfigurationItem `json:"configurationItem"`
+	ConfigurationItemSummary *ConfigConfigurationItem `json:"configurationItemSummary"`
+}
+
+// ConfigConfigurationItem Struct for the configuration item, or configuration
+// item summary, of a changed resource
+type ConfigConfigurationItem struct {
+	ResourceType                 string    `json:"resourceType"`
+	ResourceID                   string    `json:"resourceId"`
+	ResourceName                 string    `json:"resourceName"`
+	ConfigurationItemStatus      string    `json:"configurationItemStatus"`
+	ConfigurationItemCaptureTime time.Time `json:"configurationItemCaptureTime"`
+}
+
+// startConfigRule runs the tool as a custom AWS Config rule Lambda function
+func startConfigRule() {
+	lambda.Start(handleConfigEvent)
+}
+
+func handleConfigEvent(ctx context.Context, configEvent events.ConfigEvent) error {
+	localLogger := log.WithFields(logrus.Fields{
+		"action":   "evaluateConfigRule",
+		"ruleName": configEvent.ConfigRuleName,
+	})
+
+	var invokingEvent ConfigInvokingEvent
+	err := json.Unmarshal([]byte(configEvent.InvokingEvent), &invokingEvent)
+	if err != nil {
+		return fmt.Errorf("could not parse invoking event: %s", err)
+	}
+
+	params, err := parseConfigRuleParameters(configEvent.RuleParameters)
+	if err != nil {
+		return err
+	}
+
+	evaluations := make([]*configservice.Evaluation, 0)
+
+	switch invokingEvent.MessageType {
+	case "ConfigurationItemChangeNotification", "OversizedConfigurationItemChangeNotification":
+		item := invokingEvent.ConfigurationItem
+		if item == nil {
+			item = invokingEvent.ConfigurationItemSummary
+		}
+		if item == nil || item.ResourceType != configTableResourceType {
+			localLogger.Debug("Ignoring configuration item that is not a DynamoDB table")
+			break
+		}
+
+		evaluation := &configservice.Evaluation{
+			ComplianceResourceType: aws.String(configTableResourceType),
+			ComplianceResourceId:   aws.String(item.ResourceID),
+			OrderingTimestamp:      aws.Time(item.ConfigurationItemCaptureTime),
+		}
+		if configEvent.EventLeftScope || strings.HasPrefix(item.ConfigurationItemStatus, "ResourceDeleted") {
+			evaluation.ComplianceType = aws.String(configservice.ComplianceTypeNotApplicable)
+		} else {
+			evaluation.ComplianceType, evaluation.Annotation = evaluateTableCompliance(item.ResourceName, params)
+		}
+		evaluations = append(evaluations, evaluation)
+
+	case "ScheduledNotification":
+		// a failed listing must fail the invocation, or Config would keep
+		// its previous results as if every table had been evaluated
+		tableNames, err := listTableNames()
+		if err != nil {
+			return err
+		}
+		for _, table := range tableNames {
+			evaluation := &configservice.Evaluation{
+				ComplianceResourceType: aws.String(configTableResourceType),
+				ComplianceResourceId:   aws.String(table),
+				OrderingTimestamp:      aws.Time(invokingEvent.NotificationCreationTime),
+			}
+			evaluation.ComplianceType, evaluation.Annotation = evaluateTableCompliance(table, params)
+			evaluations = append(evaluations, evaluation)
+		}
+
+	default:
+		return fmt.Errorf("unsupported message type %s", invokingEvent.MessageType)
+	}
+
+	for start := 0; start < len(evaluations); start += configEvaluationBatchSize {
+		end := start + configEvaluationBatchSize
+		if end > len(evaluations) {
+			end = len(evaluations)
+		}
+
+		putEvaluationsOutput, err := configService.PutEvaluationsWithContext(ctx, &configservice.PutEvaluationsInput{
+			ResultToken: aws.String(configEvent.ResultToken),
+			Evaluations: evaluations[start:end],
+		})
+		if err != nil {
+			return err
+		}
+		if len(putEvaluationsOutput.FailedEvaluations) > 0 {
+			localLogger.WithFields(logrus.Fields{
+				"failedEvaluations": putEvaluationsOutput.FailedEvaluations,
+			}).Error("Config rejected some evaluations")
+		}
+	}
+
+	localLogger.WithFields(logrus.Fields{
+		"count": len(evaluations),
+	}).Info(fmt.Sprintf("Reported %d evaluations", len(evaluations)))
+
+	return nil
+}
+
+// parseConfigRuleParameters reads the rule parameters, which Config passes as
+// a JSON object of strings
+func parseConfigRuleParameters(ruleParameters string) (*ConfigRuleParameters, error) {
+	params := &ConfigRuleParameters{
+		MaxBackupAgeHours: 25,
+		RequirePITR:       true,
+	}
+	if ruleParameters == "" {
+		return params, nil
+	}
+
+	values := make(map[string]string)
+	err := json.Unmarshal([]byte(ruleParameters), &values)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rule parameters: %s", err)
+	}
+
+	for name, value := range values {
+		switch name {
+		case "maxBackupAgeHours":
+			params.MaxBackupAgeHours, err = strconv.Atoi(value)
+		case "requirePitr":
+			params.RequirePITR, err = strconv.ParseBool(value)
+		case "minRetentionDays":
+			params.MinRetentionDays, err = strconv.Atoi(value)
+		case "requireKmsEncryption":
+			params.RequireKMSEncryption, err = strconv.ParseBool(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule parameter %s: %s", name, err)
+		}
+	}
+
+	return params, nil
+}
+
+// evaluateTableCompliance checks a table for a recent backup, PITR, retention
+// and encryption, returning the compliance type and an annotation listing
+// the checks that failed
+func evaluateTableCompliance(table string, params *ConfigRuleParameters) (*string, *string) {
+	problems := make([]string, 0)
+
+	backups, err := listTableBackups(table)
+	if err != nil {
+		return aws.String(configservice.ComplianceTypeInsufficientData), configAnnotation(err.Error())
+	}
+
+	var latestBackup time.Time
+	for _, backup := range backups {
+		if aws.StringValue(backup.BackupStatus) != dynamodb.BackupStatusAvailable {
+			continue
+		}
+		if backup.BackupCreationDateTime.After(latestBackup) {
+			latestBackup = *backup.BackupCreationDateTime
+		}
+	}
+	maxBackupAge := time.Duration(params.MaxBackupAgeHours) * time.Hour
+	if latestBackup.IsZero() {
+		problems = append(problems, "no available backup")
+	} else if time.Since(latestBackup) > maxBackupAge {
+		problems = append(problems, fmt.Sprintf("latest backup older than %dh", params.MaxBackupAgeHours))
+	}
+
+	if params.RequirePITR {
+		continuousBackupsOutput, err := dynamo.DescribeContinuousBackups(&dynamodb.DescribeContinuousBackupsInput{
+			TableName: &table,
+		})
+		if err != nil {
+			return aws.String(configservice.ComplianceTypeInsufficientData), configAnnotation(err.Error())
+		}
+		description := continuousBackupsOutput.ContinuousBackupsDescription
+		if description == nil || description.PointInTimeRecoveryDescription == nil ||
+			aws.StringValue(description.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus) != dynamodb.PointInTimeRecoveryStatusEnabled {
+			problems = append(problems, "PITR disabled")
+		}
+	}
+
+	if params.MinRetentionDays > 0 {
+		patternRegex, err := regexp.Compile(config.TableRegex)
+		if err != nil || len(matchTables(patternRegex, []string{table})) == 0 {
+			problems = append(problems, "not covered by backup policy")
+		} else if config.BackupExpireDays < params.MinRetentionDays {
+			problems = append(problems, fmt.Sprintf("retention %dd below %dd", config.BackupExpireDays, params.MinRetentionDays))
+		}
+	}
+
+	if params.RequireKMSEncryption {
+		describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+			TableName: &table,
+		})
+		if err != nil {
+			return aws.String(configservice.ComplianceTypeInsufficientData), configAnnotation(err.Error())
+		}
+		sse := describeTableOutput.Table.SSEDescription
+		if sse == nil || aws.StringValue(sse.SSEType) != dynamodb.SSETypeKms ||
+			aws.StringValue(sse.Status) != dynamodb.SSEStatusEnabled {
+			problems = append(problems, "not encrypted with KMS")
+		}
+	}
+
+	if len(problems) > 0 {
+		return aws.String(configservice.ComplianceTypeNonCompliant), configAnnotation(strings.Join(problems, "; "))
+	}
+	return aws.String(configservice.ComplianceTypeCompliant), nil
+}
+
+func configAnnotation(annotation string) *string {
+	if len(annotation) > configAnnotationMaxLength {
+		annotation = annotation[:configAnnotationMaxLength]
+	}
+	return aws.String(annotation)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/configservice/configserviceiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// invoking events as sent by AWS Config, trimmed to the fields the rule reads
+const (
+	tableChangeEvent = `{
+		"messageType": "ConfigurationItemChangeNotification",
+		"notificationCreationTime": "2024-03-01T12:00:00.000Z",
+		"configurationItem": {
+			"resourceType": "AWS::DynamoDB::Table",
+			"resourceId": "%s",
+			"resourceName": "%s",
+			"configurationItemStatus": "OK",
+			"configurationItemCaptureTime": "2024-03-01T11:59:00.000Z"
+		}
+	}`
+	tableDeletedEvent = `{
+		"messageType": "ConfigurationItemChangeNotification",
+		"notificationCreationTime": "2024-03-01T12:00:00.000Z",
+		"configurationItem": {
+			"resourceType": "AWS::DynamoDB::Table",
+			"resourceId": "orders",
+			"resourceName": "orders",
+			"configurationItemStatus": "ResourceDeleted",
+			"configurationItemCaptureTime": "2024-03-01T11:59:00.000Z"
+		}
+	}`
+	oversizedChangeEvent = `{
+		"messageType": "OversizedConfigurationItemChangeNotification",
+		"notificationCreationTime": "2024-03-01T12:00:00.000Z",
+		"configurationItemSummary": {
+			"changeType": "UPDATE",
+			"resourceType": "AWS::DynamoDB::Table",
+			"resourceId": "stale",
+			"resourceName": "stale",
+			"configurationItemStatus": "OK",
+			"configurationItemCaptureTime": "2024-03-01T11:59:00.000Z"
+		}
+	}`
+	bucketChangeEvent = `{
+		"messageType": "ConfigurationItemChangeNotification",
+		"notificationCreationTime": "2024-03-01T12:00:00.000Z",
+		"configurationItem": {
+			"resourceType": "AWS::S3::Bucket",
+			"resourceId": "logs",
+			"resourceName": "logs",
+			"configurationItemStatus": "OK",
+			"configurationItemCaptureTime": "2024-03-01T11:59:00.000Z"
+		}
+	}`
+	scheduledEvent = `{
+		"messageType": "ScheduledNotification",
+		"notificationCreationTime": "2024-03-01T12:00:00.000Z"
+	}`
+)
+
+// fakeConfigDynamo serves the DynamoDB calls made by the Config rule from
+// fixture tables
+type fakeConfigDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	tables        []string
+	listTablesErr error
+	backups       map[string][]*dynamodb.BackupSummary
+	pitr          map[string]bool
+	kms           map[string]bool
+}
+
+func (fake *fakeConfigDynamo) ListTablesPages(input *dynamodb.ListTablesInput, fn func(*dynamodb.ListTablesOutput, bool) bool) error {
+	if fake.listTablesErr != nil {
+		return fake.listTablesErr
+	}
+	fn(&dynamodb.ListTablesOutput{TableNames: aws.StringSlice(fake.tables)}, true)
+	return nil
+}
+
+func (fake *fakeConfigDynamo) ListBackups(input *dynamodb.ListBackupsInput) (*dynamodb.ListBackupsOutput, error) {
+	return &dynamodb.ListBackupsOutput{BackupSummaries: fake.backups[*input.TableName]}, nil
+}
+
+func (fake *fakeConfigDynamo) DescribeContinuousBackups(input *dynamodb.DescribeContinuousBackupsInput) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	status := dynamodb.PointInTimeRecoveryStatusDisabled
+	if fake.pitr[*input.TableName] {
+		status = dynamodb.PointInTimeRecoveryStatusEnabled
+	}
+	return &dynamodb.DescribeContinuousBackupsOutput{
+		ContinuousBackupsDescription: &dynamodb.ContinuousBackupsDescription{
+			PointInTimeRecoveryDescription: &dynamodb.PointInTimeRecoveryDescription{
+				PointInTimeRecoveryStatus: aws.String(status),
+			},
+		},
+	}, nil
+}
+
+func (fake *fakeConfigDynamo) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	table := &dynamodb.TableDescription{TableName: input.TableName}
+	if fake.kms[*input.TableName] {
+		table.SSEDescription = &dynamodb.SSEDescription{
+			SSEType: aws.String(dynamodb.SSETypeKms),
+			Status:  aws.String(dynamodb.SSEStatusEnabled),
+		}
+	}
+	return &dynamodb.DescribeTableOutput{Table: table}, nil
+}
+
+// fakeConfigService records the evaluations put by the Config rule
+type fakeConfigService struct {
+	configserviceiface.ConfigServiceAPI
+	evaluations []*configservice.Evaluation
+}
+
+func (fake *fakeConfigService) PutEvaluationsWithContext(ctx aws.Context, input *configservice.PutEvaluationsInput, opts ...request.Option) (*configservice.PutEvaluationsOutput, error) {
+	fake.evaluations = append(fake.evaluations, input.Evaluations...)
+	return &configservice.PutEvaluationsOutput{}, nil
+}
+
+// withFakeConfigClients swaps the AWS clients for fakes serving three tables:
+// orders is compliant, stale has an old backup and no PITR, and empty has no
+// backups at all
+func withFakeConfigClients(t *testing.T) *fakeConfigService {
+	now := time.Now()
+	fakeDynamo := &fakeConfigDynamo{
+		tables: []string{"empty", "orders", "stale"},
+		backups: map[string][]*dynamodb.BackupSummary{
+			"orders": {
+				{BackupStatus: aws.String(dynamodb.BackupStatusAvailable), BackupCreationDateTime: aws.Time(now.Add(-2 * time.Hour))},
+				{BackupStatus: aws.String(dynamodb.BackupStatusCreating), BackupCreationDateTime: aws.Time(now.Add(-time.Minute))},
+			},
+			"stale": {
+				{BackupStatus: aws.String(dynamodb.BackupStatusAvailable), BackupCreationDateTime: aws.Time(now.Add(-72 * time.Hour))},
+			},
+		},
+		pitr: map[string]bool{"orders": true, "empty": true},
+		kms:  map[string]bool{"orders": true},
+	}
+	fakeConfig := &fakeConfigService{}
+
+	previousDynamo, previousConfig := dynamo, configService
+	dynamo, configService = fakeDynamo, fakeConfig
+	t.Cleanup(func() {
+		dynamo, configService = previousDynamo, previousConfig
+	})
+
+	return fakeConfig
+}
+
+type expectedEvaluation struct {
+	resourceID     string
+	complianceType string
+	annotation     string
+}
+
+func TestHandleConfigEvent(t *testing.T) {
+	testCases := []struct {
+		name           string
+		invokingEvent  string
+		ruleParameters string
+		eventLeftScope bool
+		expected       []expectedEvaluation
+	}{
+		{
+			name:          "compliant table change",
+			invokingEvent: tableEvent(tableChangeEvent, "orders"),
+			expected:      []expectedEvaluation{{"orders", configservice.ComplianceTypeCompliant, ""}},
+		},
+		{
+			name:          "non-compliant table change",
+			invokingEvent: tableEvent(tableChangeEvent, "stale"),
+			expected:      []expectedEvaluation{{"stale", configservice.ComplianceTypeNonCompliant, "latest backup older than 25h; PITR disabled"}},
+		},
+		{
+			name:           "rule parameters",
+			invokingEvent:  tableEvent(tableChangeEvent, "stale"),
+			ruleParameters: `{"maxBackupAgeHours": "96", "requirePitr": "false"}`,
+			expected:       []expectedEvaluation{{"stale", configservice.ComplianceTypeCompliant, ""}},
+		},
+		{
+			name:          "oversized change uses the item summary",
+			invokingEvent: oversizedChangeEvent,
+			expected:      []expectedEvaluation{{"stale", configservice.ComplianceTypeNonCompliant, "latest backup older than 25h; PITR disabled"}},
+		},
+		{
+			name:          "deleted table",
+			invokingEvent: tableDeletedEvent,
+			expected:      []expectedEvaluation{{"orders", configservice.ComplianceTypeNotApplicable, ""}},
+		},
+		{
+			name:           "table left scope",
+			invokingEvent:  tableEvent(tableChangeEvent, "orders"),
+			eventLeftScope: true,
+			expected:       []expectedEvaluation{{"orders", configservice.ComplianceTypeNotApplicable, ""}},
+		},
+		{
+			name:          "other resource type",
+			invokingEvent: bucketChangeEvent,
+			expected:      []expectedEvaluation{},
+		},
+		{
+			name:          "scheduled",
+			invokingEvent: scheduledEvent,
+			expected: []expectedEvaluation{
+				{"empty", configservice.ComplianceTypeNonCompliant, "no available backup"},
+				{"orders", configservice.ComplianceTypeCompliant, ""},
+				{"stale", configservice.ComplianceTypeNonCompliant, "latest backup older than 25h; PITR disabled"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			fakeConfig := withFakeConfigClients(t)
+
+			err := handleConfigEvent(context.Background(), events.ConfigEvent{
+				ConfigRuleName: "dynamodb-backup-compliance",
+				EventLeftScope: testCase.eventLeftScope,
+				InvokingEvent:  testCase.invokingEvent,
+				ResultToken:    "result-token",
+				RuleParameters: testCase.ruleParameters,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := make([]expectedEvaluation, 0)
+			for _, evaluation := range fakeConfig.evaluations {
+				actual = append(actual, expectedEvaluation{
+					resourceID:     aws.StringValue(evaluation.ComplianceResourceId),
+					complianceType: aws.StringValue(evaluation.ComplianceType),
+					annotation:     aws.StringValue(evaluation.Annotation),
+				})
+			}
+			if !reflect.DeepEqual(testCase.expected, actual) {
+				t.Errorf("expected evaluations %v, got %v", testCase.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleConfigEventUnsupportedMessage(t *testing.T) {
+	withFakeConfigClients(t)
+
+	err := handleConfigEvent(context.Background(), events.ConfigEvent{
+		InvokingEvent: `{"messageType": "ConfigurationSnapshotDeliveryCompleted"}`,
+	})
+	if err == nil {
+		t.Error("expected an error for an unsupported message type")
+	}
+}
+
+func TestHandleConfigEventListTablesError(t *testing.T) {
+	fakeConfig := withFakeConfigClients(t)
+	dynamo.(*fakeConfigDynamo).listTablesErr = fmt.Errorf("AccessDeniedException: not authorized to perform dynamodb:ListTables")
+
+	err := handleConfigEvent(context.Background(), events.ConfigEvent{
+		InvokingEvent: scheduledEvent,
+	})
+	if err == nil {
+		t.Error("expected an error when tables cannot be listed")
+	}
+	if len(fakeConfig.evaluations) != 0 {
+		t.Errorf("expected no evaluations, got %d", len(fakeConfig.evaluations))
+	}
+}
+
+func TestParseConfigRuleParameters(t *testing.T) {
+	testCases := []struct {
+		name           string
+		ruleParameters string
+		expected       *ConfigRuleParameters
+		expectError    bool
+	}{
+		{
+			name:     "defaults",
+			expected: &ConfigRuleParameters{MaxBackupAgeHours: 25, RequirePITR: true},
+		},
+		{
+			name:           "all parameters",
+			ruleParameters: `{"maxBackupAgeHours": "48", "requirePitr": "false", "minRetentionDays": "7", "requireKmsEncryption": "true"}`,
+			expected:       &ConfigRuleParameters{MaxBackupAgeHours: 48, MinRetentionDays: 7, RequireKMSEncryption: true},
+		},
+		{
+			name:           "unknown parameter",
+			ruleParameters: `{"maxBackupAge": "48"}`,
+			expectError:    true,
+		},
+		{
+			name:           "invalid value",
+			ruleParameters: `{"requirePitr": "sometimes"}`,
+			expectError:    true,
+		},
+		{
+			name:           "not an object of strings",
+			ruleParameters: `{"maxBackupAgeHours": 48}`,
+			expectError:    true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			params, err := parseConfigRuleParameters(testCase.ruleParameters)
+			if testCase.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expected, params) {
+				t.Errorf("expected %+v, got %+v", testCase.expected, params)
+			}
+		})
+	}
+}
+
+func TestEvaluateTableCompliance(t *testing.T) {
+	testCases := []struct {
+		name           string
+		table          string
+		params         ConfigRuleParameters
+		tableRegex     string
+		complianceType string
+		annotation     string
+	}{
+		{
+			name:           "retention below minimum",
+			table:          "orders",
+			params:         ConfigRuleParameters{MaxBackupAgeHours: 25, MinRetentionDays: 7},
+			tableRegex:     "^orders$",
+			complianceType: configservice.ComplianceTypeNonCompliant,
+			annotation:     "retention 1d below 7d",
+		},
+		{
+			name:           "not covered by policy",
+			table:          "stale",
+			params:         ConfigRuleParameters{MaxBackupAgeHours: 96, MinRetentionDays: 1},
+			tableRegex:     "^orders$",
+			complianceType: configservice.ComplianceTypeNonCompliant,
+			annotation:     "not covered by backup policy",
+		},
+		{
+			name:           "KMS encryption",
+			table:          "orders",
+			params:         ConfigRuleParameters{MaxBackupAgeHours: 25, RequireKMSEncryption: true},
+			complianceType: configservice.ComplianceTypeCompliant,
+		},
+		{
+			name:           "no KMS encryption",
+			table:          "stale",
+			params:         ConfigRuleParameters{MaxBackupAgeHours: 96, RequireKMSEncryption: true},
+			complianceType: configservice.ComplianceTypeNonCompliant,
+			annotation:     "not encrypted with KMS",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			withFakeConfigClients(t)
+
+			caseConfig, err := loadConfig(map[string]string{"TABLE_REGEX": testCase.tableRegex})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var complianceType, annotation *string
+			withConfig(caseConfig, func() {
+				complianceType, annotation = evaluateTableCompliance(testCase.table, &testCase.params)
+			})
+
+			if aws.StringValue(complianceType) != testCase.complianceType {
+				t.Errorf("expected %s, got %s", testCase.complianceType, aws.StringValue(complianceType))
+			}
+			if aws.StringValue(annotation) != testCase.annotation {
+				t.Errorf("expected annotation %q, got %q", testCase.annotation, aws.StringValue(annotation))
+			}
+		})
+	}
+}
+
+// tableEvent fills the resource ID and name of a change event
+func tableEvent(event string, table string) string {
+	return fmt.Sprintf(event, table, table)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// Tag keys written onto tables to summarize backup health
+const (
+	healthLastSuccessTag = "backup:last-success"
+	healthPolicyTag      = "backup:policy"
+	healthStatusTag      = "backup:status"
+)
+
+// TagResource is limited to 5 calls per second per account
+const tagResourceInterval = 200 * time.Millisecond
+
+// tagResourceThrottle is shared by every goroutine that tags tables, so that
+// concurrent queue workers stay under the limit together
+var tagResourceThrottle = time.Tick(tagResourceInterval)
+
+// HealthResult Struct for the outcome of a run for one table. BackupArn is
+// the backup created by the run, if any, and Error a create or expire error.
+type HealthResult struct {
+	TableName string
+	BackupArn string
+	Error     error
+}
+
+// writeHealthTags tags every table handled by this run with a summary of its
+// backup health. Tables are only tagged when a value changed.
+func writeHealthTags(results []HealthResult) {
+	for _, result := range results {
+		localLogger := log.WithFields(logrus.Fields{
+			"table":  result.TableName,
+			"action": "writeHealthTags",
+		})
+
+		// tag the outcome of the new backup rather than its CREATING state
+		if result.BackupArn != "" {
+			waitForBackup(result.TableName, result.BackupArn)
+		}
+
+		tags, err := getHealthTags(result)
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+
+		changed, tableArn, err := getChangedTags(result.TableName, tags)
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+		if len(changed) == 0 {
+			localLogger.Debug("Health tags unchanged")
+			continue
+		}
+
+		<-tagResourceThrottle
+
+		_, err = dynamo.TagResource(&dynamodb.TagResourceInput{
+			ResourceArn: tableArn,
+			Tags:        changed,
+		})
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+
+		localLogger.WithFields(logrus.Fields{
+			"tags": tags,
+		}).Info(fmt.Sprintf("Updated health tags for table %s", result.TableName))
+	}
+}
+
+// getHealthTags returns the health tag values for a table from its backups.
+// The last success is the creation time of the newest available backup, and
+// the status is that of the newest backup, or failed if the run had an error.
+func getHealthTags(result HealthResult) (map[string]string, error) {
+	backups, err := listTableBackups(result.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest, latestAvailable *dynamodb.BackupSummary
+	for _, backup := range backups {
+		created := aws.TimeValue(backup.BackupCreationDateTime)
+		if latest == nil || created.After(aws.TimeValue(latest.BackupCreationDateTime)) {
+			latest = backup
+		}
+		if aws.StringValue(backup.BackupStatus) != dynamodb.BackupStatusAvailable {
+			continue
+		}
+		if latestAvailable == nil || created.After(aws.TimeValue(latestAvailable.BackupCreationDateTime)) {
+			latestAvailable = backup
+		}
+	}
+
+	tags := map[string]string{
+		healthPolicyTag: fmt.Sprintf("expire=%dd grace=%dd", config.BackupExpireDays, config.BackupDeleteGraceDays),
+	}
+	if latestAvailable != nil {
+		tags[healthLastSuccessTag] = aws.TimeValue(latestAvailable.BackupCreationDateTime).UTC().Format(time.RFC3339)
+	}
+
+	switch {
+	case result.Error != nil || latest == nil:
+		tags[healthStatusTag] = "failed"
+	case aws.StringValue(latest.BackupStatus) == dynamodb.BackupStatusAvailable:
+		tags[healthStatusTag] = "ok"
+	default:
+		tags[healthStatusTag] = strings.ToLower(aws.StringValue(latest.BackupStatus))
+	}
+
+	return tags, nil
+}
+
+// getChangedTags returns the tags whose values differ from those currently
+// on the table, along with the table ARN
+func getChangedTags(table string, tags map[string]string) ([]*dynamodb.Tag, *string, error) {
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	tableArn := describeTableOutput.Table.TableArn
+
+	currentTags, err := listResourceTags(tableArn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current := make(map[string]string)
+	for _, tag := range currentTags {
+		current[*tag.Key] = *tag.Value
+	}
+
+	changed := make([]*dynamodb.Tag, 0)
+	for key, value := range tags {
+		if existing, ok := current[key]; ok && existing == value {
+			continue
+		}
+		changed = append(changed, &dynamodb.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+
+	return changed, tableArn, nil
+}
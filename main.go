@@ -3,12 +3,19 @@ package main
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/applicationautoscaling"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/configservice/configserviceiface"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
 	"github.com/caarlos0/env"
 	"github.com/onrik/logrus/filename"
 	"github.com/sirupsen/logrus"
@@ -16,16 +23,39 @@ import (
 
 // Config struct for storing app config data
 type Config struct {
-	TableRegex       string `env:"TABLE_REGEX"`
-	BackupExpireDays int    `env:"BACKUP_EXPIRE_DAYS" envDefault:"1"`
-	LogLevel         string `env:"LOG_LEVEL" envDefault:"info"`
-	LogFormatter     string `env:"LOG_FORMATTER" envDefault:"text"`
+	TableRegex            string `env:"TABLE_REGEX"`
+	BackupExpireDays      int    `env:"BACKUP_EXPIRE_DAYS" envDefault:"1"`
+	BackupDeleteGraceDays int    `env:"BACKUP_DELETE_GRACE_DAYS" envDefault:"0"`
+	PendingDeletionTable  string `env:"PENDING_DELETION_TABLE" envDefault:"dynamodb-backups-pending-deletions"`
+	LogLevel              string `env:"LOG_LEVEL" envDefault:"info"`
+	LogFormatter          string `env:"LOG_FORMATTER" envDefault:"text"`
+
+	BackupQuotaCode           string `env:"BACKUP_QUOTA_CODE"`
+	BackupConcurrencyFallback int    `env:"BACKUP_CONCURRENCY_FALLBACK" envDefault:"50"`
+
+	ConsistencyMarkerEnabled bool   `env:"CONSISTENCY_MARKER_ENABLED" envDefault:"false"`
+	ConsistencyMarkerKey     string `env:"CONSISTENCY_MARKER_KEY" envDefault:"dynamodb-backups-marker"`
+	ConsistencyMarkerTTLDays int    `env:"CONSISTENCY_MARKER_TTL_DAYS" envDefault:"7"`
+
+	TableHealthTagsEnabled bool `env:"TABLE_HEALTH_TAGS_ENABLED" envDefault:"false"`
+
+	// run as a custom AWS Config rule Lambda function instead of backing up
+	ConfigRuleMode bool `env:"CONFIG_RULE_MODE" envDefault:"false"`
+
+	// process tables through a job queue ("memory" or "dynamodb") instead of channels
+	JobQueue        string `env:"JOB_QUEUE"`
+	JobQueueTable   string `env:"JOB_QUEUE_TABLE" envDefault:"dynamodb-backups-jobs"`
+	JobQueueIndex   string `env:"JOB_QUEUE_INDEX" envDefault:"status-notBefore"`
+	JobWorkers      int    `env:"JOB_WORKERS" envDefault:"4"`
+	JobLeaseSeconds int    `env:"JOB_LEASE_SECONDS" envDefault:"300"`
+	JobMaxAttempts  int    `env:"JOB_MAX_ATTEMPTS" envDefault:"3"`
 }
 
 // ExpireMessage Struct for messages sent over the expire channel
 type ExpireMessage struct {
 	TableName string
 	Count     int
+	Pending   []PendingDeletion
 	Error     error
 }
 
@@ -33,6 +63,8 @@ type ExpireMessage struct {
 type CreateMessage struct {
 	TableName  string
 	BackupName string
+	BackupArn  string
+	Marker     *ConsistencyMarker
 	Error      error
 }
 
@@ -40,11 +72,23 @@ type CreateMessage struct {
 type DeleteMessage struct {
 	TableName  string
 	BackupName string
+	Pending    *PendingDeletion
+	Kept       bool
 	Error      error
 }
 
+// Actions taken on a backup when expiring backups
+const (
+	expiryKeep    = "keep"
+	expiryPending = "pending"
+	expiryDelete  = "delete"
+)
+
 var config = &Config{}
-var dynamo = &dynamodb.DynamoDB{}
+var dynamo dynamodbiface.DynamoDBAPI = &dynamodb.DynamoDB{}
+var serviceQuotas = &servicequotas.ServiceQuotas{}
+var configService configserviceiface.ConfigServiceAPI = &configservice.ConfigService{}
+var autoScaling = &applicationautoscaling.ApplicationAutoScaling{}
 var log = &logrus.Entry{}
 
 func init() {
@@ -52,8 +96,12 @@ func init() {
 	// parse configuration
 	env.Parse(config)
 
-	// initialize dynamo client
-	dynamo = dynamodb.New(session.New())
+	// initialize aws clients
+	sess := session.New()
+	dynamo = dynamodb.New(sess)
+	serviceQuotas = servicequotas.New(sess)
+	configService = configservice.New(sess)
+	autoScaling = applicationautoscaling.New(sess)
 
 	// Output to stdout
 	logrus.SetOutput(os.Stdout)
@@ -89,10 +137,120 @@ func init() {
 	)
 }
 
+// loadConfig parses a Config from values alone, resolving each field from its
+// env tag and falling back to its envDefault. The process environment is
+// neither read nor changed, so the result does not depend on the caller's
+// shell and loadConfig is safe to call while other goroutines run.
+func loadConfig(values map[string]string) (*Config, error) {
+	loaded := &Config{}
+	fields := reflect.ValueOf(loaded).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		value, ok := values[name]
+		if !ok {
+			value, ok = field.Tag.Lookup("envDefault")
+		}
+		if !ok {
+			continue
+		}
+
+		err := setConfigField(fields.Field(i), value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return loaded, nil
+}
+
+// setConfigField parses value into a Config field of a kind Config uses
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(flag)
+	default:
+		return fmt.Errorf("unsupported config field type %s", field.Type())
+	}
+	return nil
+}
+
+// withConfig runs fn with the global config temporarily replaced
+func withConfig(replacement *Config, fn func()) {
+	previous := config
+	config = replacement
+	defer func() { config = previous }()
+
+	fn()
+}
+
 func main() {
+	if config.ConfigRuleMode {
+		startConfigRule()
+		return
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "undelete":
+			undeleteBackups(os.Args[2:])
+		case "runbook":
+			writeRunbooks(os.Args[2:])
+		case "marker":
+			reportConsistencyMarkers(os.Args[2:])
+		case "policy":
+			policyCommand(os.Args[2:])
+		case "config":
+			configCommand(os.Args[2:])
+		case "plan":
+			planCommand(os.Args[2:])
+		case "worker":
+			workerCommand(os.Args[2:])
+		case "report":
+			reportCommand(os.Args[2:])
+		case "dump":
+			dumpCommand(os.Args[2:])
+		case "sync":
+			syncCommand(os.Args[2:])
+		case "capacity":
+			capacityCommand(os.Args[2:])
+		default:
+			log.Fatal(fmt.Sprintf("Unknown command %s", os.Args[1]))
+		}
+		return
+	}
+
+	if config.JobQueue != "" {
+		runQueued()
+		return
+	}
+
+	runBackups()
+}
+
+func runBackups() {
 	start := time.Now()
+	runID := fmt.Sprintf("%d", start.UnixNano())
 
-	matchedTables := getTablesRegex(config.TableRegex)
+	matchedTables, err := getTablesRegex(config.TableRegex)
+	if err != nil {
+		log.Fatal(err)
+	}
 	tableCount := len(matchedTables)
 
 	log.WithFields(logrus.Fields{
@@ -104,30 +262,67 @@ func main() {
 	createChannel := make(chan CreateMessage, tableCount)
 	expireChannel := make(chan ExpireMessage, tableCount)
 
+	createConcurrency, quotaBound := getCreateConcurrency(tableCount)
+	createSlots := make(chan struct{}, createConcurrency)
+
 	for _, table := range matchedTables {
 
-		go createBackup(table, createChannel)
+		go createBackupWithSlot(table, runID, createSlots, quotaBound, createChannel)
 		go expireBackups(table, expireChannel)
 	}
 
+	createMessages := make([]CreateMessage, 0, tableCount)
 	for i := 0; i < tableCount; i++ {
 		createMessage := <-createChannel
+		createMessages = append(createMessages, createMessage)
 		tableName := createMessage.TableName
 		backupName := createMessage.BackupName
 		log.WithFields(logrus.Fields{
 			"table":      tableName,
 			"backupName": backupName,
 		}).Info(fmt.Sprintf("Created backup for table %s", tableName))
+		if createMessage.Marker != nil {
+			log.WithFields(logrus.Fields{
+				"table":      tableName,
+				"backupName": backupName,
+				"runId":      createMessage.Marker.RunID,
+				"markedAt":   createMessage.Marker.Timestamp,
+			}).Info(fmt.Sprintf("Backup %s includes writes up to %s", backupName, createMessage.Marker.Timestamp.Format(time.RFC3339Nano)))
+		}
 	}
 
+	expireErrors := make(map[string]error)
+	pendingQueue := make([]PendingDeletion, 0)
 	for i := 0; i < tableCount; i++ {
 		expireMessage := <-expireChannel
+		if expireMessage.Error != nil {
+			expireErrors[expireMessage.TableName] = expireMessage.Error
+		}
 		tableName := expireMessage.TableName
 		deletedCount := expireMessage.Count
 		log.WithFields(logrus.Fields{
 			"table": tableName,
 			"count": deletedCount,
 		}).Info(fmt.Sprintf("Deleted %d backups from table %s", deletedCount, tableName))
+		pendingQueue = append(pendingQueue, expireMessage.Pending...)
+	}
+
+	reportPendingDeletions(pendingQueue)
+
+	if config.TableHealthTagsEnabled {
+		healthResults := make([]HealthResult, 0, len(createMessages))
+		for _, createMessage := range createMessages {
+			result := HealthResult{
+				TableName: createMessage.TableName,
+				BackupArn: createMessage.BackupArn,
+				Error:     createMessage.Error,
+			}
+			if result.Error == nil {
+				result.Error = expireErrors[createMessage.TableName]
+			}
+			healthResults = append(healthResults, result)
+		}
+		writeHealthTags(healthResults)
 	}
 
 	elapsed := time.Since(start)
@@ -135,39 +330,49 @@ func main() {
 	log.Info(fmt.Sprintf("Main() execution time: %s", elapsed))
 }
 
-func getTablesRegex(pattern string) []string {
+func getTablesRegex(pattern string) ([]string, error) {
 
-	matchedTables := make([]string, 0)
 	patternRegex, _ := regexp.Compile(pattern)
 
-	pageNum := 0
+	tableNames, err := listTableNames()
+	if err != nil {
+		return nil, err
+	}
+	return matchTables(patternRegex, tableNames), nil
+}
+
+// listTableNames returns the names of every table in the account and region.
+// A listing that fails part way is an error rather than a shorter list, so
+// callers never mistake missing permissions for an account without tables.
+func listTableNames() ([]string, error) {
+
+	tableNames := make([]string, 0)
+
 	input := &dynamodb.ListTablesInput{}
 	err := dynamo.ListTablesPages(input,
 		func(page *dynamodb.ListTablesOutput, lastPage bool) bool {
-			pageNum++
-			for _, name := range page.TableNames {
-				if patternRegex.MatchString(*name) {
-					matchedTables = append(matchedTables, *name)
-				}
-			}
-			return lastPage
+			tableNames = append(tableNames, aws.StringValueSlice(page.TableNames)...)
+			return !lastPage
 		})
-
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeInternalServerError:
-				log.Error(dynamodb.ErrCodeInternalServerError, aerr.Error())
-			default:
-				log.Error(aerr.Error())
-			}
-		}
+		return nil, fmt.Errorf("could not list tables: %w", err)
 	}
 
+	return tableNames, nil
+}
+
+// matchTables returns the names selected for backup by the table pattern
+func matchTables(patternRegex *regexp.Regexp, names []string) []string {
+	matchedTables := make([]string, 0)
+	for _, name := range names {
+		if patternRegex.MatchString(name) {
+			matchedTables = append(matchedTables, name)
+		}
+	}
 	return matchedTables
 }
 
-func createBackup(table string, createChannel chan CreateMessage) {
+func createBackup(table string, runID string, createChannel chan CreateMessage) {
 
 	localLogger := log.WithFields(logrus.Fields{
 		"table": table,
@@ -182,6 +387,15 @@ func createBackup(table string, createChannel chan CreateMessage) {
 
 	backupName := fmt.Sprintf("%s_%s", table, timestamp)
 
+	var marker *ConsistencyMarker
+	if config.ConsistencyMarkerEnabled {
+		var err error
+		marker, err = writeConsistencyMarker(table, runID)
+		if err != nil {
+			localLogger.Warn(fmt.Sprintf("Could not write consistency marker, backing up without it: %s", err))
+		}
+	}
+
 	params := dynamodb.CreateBackupInput{
 		BackupName: &backupName,
 		TableName:  &table,
@@ -204,6 +418,8 @@ func createBackup(table string, createChannel chan CreateMessage) {
 		createChannel <- CreateMessage{
 			TableName:  table,
 			BackupName: backupName,
+			BackupArn:  *resp.BackupDetails.BackupArn,
+			Marker:     marker,
 		}
 	} else {
 		localLogger.Error(err)
@@ -222,7 +438,8 @@ func expireBackups(table string, expireChannel chan ExpireMessage) {
 		"table": table,
 	})
 
-	timeRangeUpperBound := time.Now().AddDate(0, 0, -config.BackupExpireDays)
+	now := time.Now().UTC()
+	timeRangeUpperBound := backupExpireCutoff(now)
 
 	listBackupsInput := dynamodb.ListBackupsInput{
 		TableName:           &table,
@@ -234,28 +451,75 @@ func expireBackups(table string, expireChannel chan ExpireMessage) {
 		"listBackupsOutput": listBackupsOutput,
 	}).Debug("listBackupsOutput")
 
-	deleteCount := len(listBackupsOutput.BackupSummaries)
-	deleteChannel := make(chan string, deleteCount)
-	if err == nil {
-		for _, backupSummary := range listBackupsOutput.BackupSummaries {
-			go deleteBackup(backupSummary, deleteChannel)
-		}
-	} else {
-		close(deleteChannel)
+	if err != nil {
 		localLogger.Error(err)
+		expireChannel <- ExpireMessage{
+			TableName: table,
+			Error:     err,
+		}
+		return
+	}
+
+	deleteCount := len(listBackupsOutput.BackupSummaries)
+	deleteChannel := make(chan DeleteMessage, deleteCount)
+	for _, backupSummary := range listBackupsOutput.BackupSummaries {
+		go expireBackup(backupSummary, now, deleteChannel)
 	}
 
+	deletedCount := 0
+	pending := make([]PendingDeletion, 0)
+	var deleteErr error
 	for i := 0; i < deleteCount; i++ {
-		<-deleteChannel
+		deleteMessage := <-deleteChannel
+		if deleteMessage.Error != nil {
+			deleteErr = deleteMessage.Error
+			continue
+		}
+		if deleteMessage.Kept {
+			continue
+		}
+		if deleteMessage.Pending != nil {
+			pending = append(pending, *deleteMessage.Pending)
+		} else {
+			deletedCount++
+		}
 	}
 
 	expireChannel <- ExpireMessage{
 		TableName: table,
-		Count:     deleteCount,
+		Count:     deletedCount,
+		Pending:   pending,
+		Error:     deleteErr,
+	}
+}
+
+// backupExpireCutoff returns the creation time before which backups expire
+func backupExpireCutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -config.BackupExpireDays)
+}
+
+// backupExpiryAction decides what a run at now does with a backup created at
+// created. markedAt is when the backup was marked as pending deletion, or the
+// zero time if it is not marked yet. An undeleted backup is always kept.
+func backupExpiryAction(created time.Time, markedAt time.Time, undeleted bool, now time.Time) string {
+	if undeleted || !created.Before(backupExpireCutoff(now)) {
+		return expiryKeep
+	}
+	if config.BackupDeleteGraceDays <= 0 {
+		return expiryDelete
+	}
+
+	// an unmarked backup is marked by this run
+	if markedAt.IsZero() {
+		markedAt = now
+	}
+	if _, due := pendingDeletionDue(markedAt, now); due {
+		return expiryDelete
 	}
+	return expiryPending
 }
 
-func deleteBackup(backupSummary *dynamodb.BackupSummary, deleteChannel chan string) {
+func deleteBackup(backupSummary *dynamodb.BackupSummary, deleteChannel chan DeleteMessage) {
 	localLogger := log.WithFields(logrus.Fields{
 		"backupName": *backupSummary.BackupName,
 		"table":      *backupSummary.TableName,
@@ -274,13 +538,20 @@ func deleteBackup(backupSummary *dynamodb.BackupSummary, deleteChannel chan stri
 	deleteBackupOutput, err := dynamo.DeleteBackup(&deleteBackupInput)
 
 	if err == nil {
-		deleteChannel <- *deleteBackupOutput.BackupDescription.BackupDetails.BackupName
+		deleteChannel <- DeleteMessage{
+			TableName:  *backupSummary.TableName,
+			BackupName: *deleteBackupOutput.BackupDescription.BackupDetails.BackupName,
+		}
 		localLogger.WithFields(logrus.Fields{
 			"deleteBackupOutput": deleteBackupOutput,
 		}).Debug("deleteBackupOutput")
 
 	} else {
-		deleteChannel <- err.Error()
+		deleteChannel <- DeleteMessage{
+			TableName:  *backupSummary.TableName,
+			BackupName: *backupSummary.BackupName,
+			Error:      err,
+		}
 		localLogger.Error(err)
 	}
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("BACKUP_EXPIRE_DAYS", "90")
+	t.Setenv("TABLE_REGEX", "^from-the-shell$")
+
+	loaded, err := loadConfig(map[string]string{
+		"TABLE_REGEX":                "^prod-",
+		"CONSISTENCY_MARKER_ENABLED": "true",
+		"JOB_WORKERS":                "8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.TableRegex != "^prod-" {
+		t.Errorf("expected TableRegex from values, got %q", loaded.TableRegex)
+	}
+	if !loaded.ConsistencyMarkerEnabled {
+		t.Error("expected ConsistencyMarkerEnabled from values")
+	}
+	if loaded.JobWorkers != 8 {
+		t.Errorf("expected JobWorkers 8, got %d", loaded.JobWorkers)
+	}
+	if loaded.BackupExpireDays != 1 {
+		t.Errorf("expected the default BackupExpireDays rather than the environment, got %d", loaded.BackupExpireDays)
+	}
+	if loaded.PendingDeletionTable != "dynamodb-backups-pending-deletions" {
+		t.Errorf("expected the default PendingDeletionTable, got %q", loaded.PendingDeletionTable)
+	}
+
+	if os.Getenv("BACKUP_EXPIRE_DAYS") != "90" || os.Getenv("TABLE_REGEX") != "^from-the-shell$" {
+		t.Error("expected the process environment to be left alone")
+	}
+}
+
+func TestLoadConfigInvalidValue(t *testing.T) {
+	_, err := loadConfig(map[string]string{"BACKUP_EXPIRE_DAYS": "seven"})
+	if err == nil {
+		t.Error("expected an error for a non-numeric BACKUP_EXPIRE_DAYS")
+	}
+}
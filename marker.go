@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// Attribute names written on consistency marker items
+const (
+	markerRunIDAttribute     = "dynamodbBackupsRunId"
+	markerTimestampAttribute = "dynamodbBackupsTimestamp"
+)
+
+// ConsistencyMarker Struct describing a marker item written before a backup
+type ConsistencyMarker struct {
+	TableName string
+	RunID     string
+	Timestamp time.Time
+}
+
+// writeConsistencyMarker puts the marker item of a run into a table, so that
+// a backup taken right after it is known to include every write acknowledged
+// before the marker timestamp.
+func writeConsistencyMarker(table string, runID string) (*ConsistencyMarker, error) {
+	key, err := getConsistencyMarkerKey(table)
+	if err != nil {
+		return nil, err
+	}
+
+	ttlAttribute, err := getTimeToLiveAttribute(table)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := &ConsistencyMarker{
+		TableName: table,
+		RunID:     runID,
+		Timestamp: time.Now().UTC(),
+	}
+	expiresAt := marker.Timestamp.AddDate(0, 0, config.ConsistencyMarkerTTLDays)
+
+	item := map[string]*dynamodb.AttributeValue{
+		markerRunIDAttribute:     {S: aws.String(marker.RunID)},
+		markerTimestampAttribute: {S: aws.String(marker.Timestamp.Format(time.RFC3339Nano))},
+	}
+	if ttlAttribute != "" {
+		item[ttlAttribute] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10)),
+		}
+	} else {
+		log.WithFields(logrus.Fields{
+			"table":  table,
+			"action": "writeConsistencyMarker",
+		}).Warn(fmt.Sprintf("Time to live is disabled on table %s, its consistency marker will not be cleaned up", table))
+	}
+	for name, value := range key {
+		item[name] = value
+	}
+
+	putItemInput := dynamodb.PutItemInput{
+		TableName: &table,
+		Item:      item,
+	}
+
+	log.WithFields(logrus.Fields{
+		"table":  table,
+		"action": "writeConsistencyMarker",
+		"runId":  marker.RunID,
+	}).Debug("Writing consistency marker")
+
+	_, err = dynamo.PutItem(&putItemInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return marker, nil
+}
+
+// getConsistencyMarker reads the marker item back from a table, returning nil
+// if the table has none.
+func getConsistencyMarker(table string) (*ConsistencyMarker, error) {
+	key, err := getConsistencyMarkerKey(table)
+	if err != nil {
+		return nil, err
+	}
+
+	getItemOutput, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if getItemOutput.Item == nil {
+		return nil, nil
+	}
+
+	marker := &ConsistencyMarker{
+		TableName: table,
+	}
+	if value, ok := getItemOutput.Item[markerRunIDAttribute]; ok {
+		marker.RunID = aws.StringValue(value.S)
+	}
+	if value, ok := getItemOutput.Item[markerTimestampAttribute]; ok {
+		marker.Timestamp, err = time.Parse(time.RFC3339Nano, aws.StringValue(value.S))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return marker, nil
+}
+
+// getConsistencyMarkerKey builds the marker item key by setting every key
+// attribute of the table to CONSISTENCY_MARKER_KEY. Only string keys are
+// supported.
+func getConsistencyMarkerKey(table string) (map[string]*dynamodb.AttributeValue, error) {
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attributeTypes := make(map[string]string)
+	for _, definition := range describeTableOutput.Table.AttributeDefinitions {
+		attributeTypes[*definition.AttributeName] = *definition.AttributeType
+	}
+
+	key := make(map[string]*dynamodb.AttributeValue)
+	for _, element := range describeTableOutput.Table.KeySchema {
+		if attributeTypes[*element.AttributeName] != dynamodb.ScalarAttributeTypeS {
+			return nil, fmt.Errorf("key attribute %s of table %s is not a string", *element.AttributeName, table)
+		}
+		key[*element.AttributeName] = &dynamodb.AttributeValue{
+			S: aws.String(config.ConsistencyMarkerKey),
+		}
+	}
+
+	return key, nil
+}
+
+// getTimeToLiveAttribute returns the time to live attribute of a table, or
+// an empty string if time to live is disabled
+func getTimeToLiveAttribute(table string) (string, error) {
+	timeToLiveOutput, err := dynamo.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	description := timeToLiveOutput.TimeToLiveDescription
+	if description == nil {
+		return "", nil
+	}
+	switch aws.StringValue(description.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return aws.StringValue(description.AttributeName), nil
+	default:
+		return "", nil
+	}
+}
+
+// reportConsistencyMarkers logs the marker found in each given table, e.g. a
+// table restored from a backup, giving the point its writes are complete up to.
+func reportConsistencyMarkers(tables []string) {
+	if len(tables) == 0 {
+		log.Fatal("Usage: dynamodb-backups marker TABLE...")
+	}
+
+	for _, table := range tables {
+		localLogger := log.WithFields(logrus.Fields{
+			"table":  table,
+			"action": "reportConsistencyMarker",
+		})
+
+		marker, err := getConsistencyMarker(table)
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+		if marker == nil {
+			localLogger.Warn(fmt.Sprintf("No consistency marker found in table %s", table))
+			continue
+		}
+
+		localLogger.WithFields(logrus.Fields{
+			"runId":    marker.RunID,
+			"markedAt": marker.Timestamp,
+		}).Info(fmt.Sprintf("Table %s includes writes up to %s", table, marker.Timestamp.Format(time.RFC3339Nano)))
+	}
+}
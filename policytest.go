@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// PolicyTestFile Struct for a file of policy test cases. Config holds
+// environment variables shared by every case; the environment the command
+// runs in is ignored, so results are the same everywhere.
+type PolicyTestFile struct {
+	Config map[string]string `json:"config"`
+	Tests  []PolicyTestCase  `json:"tests"`
+}
+
+// PolicyTestCase Struct for a single policy test case. Expectations that are
+// left out are not checked.
+type PolicyTestCase struct {
+	Name           string             `json:"name"`
+	Config         map[string]string  `json:"config"`
+	Now            *time.Time         `json:"now"`
+	Tables         []string           `json:"tables"`
+	ExpectSelected []string           `json:"expectSelected"`
+	Backups        []PolicyTestBackup `json:"backups"`
+	ExpectKeep     []string           `json:"expectKeep"`
+	ExpectPending  []string           `json:"expectPending"`
+	ExpectDelete   []string           `json:"expectDelete"`
+}
+
+// PolicyTestBackup Struct for a fixture backup. MarkedAt is the time the
+// backup was marked as pending deletion, if any, and Undeleted whether an
+// operator rescued it with the undelete command.
+type PolicyTestBackup struct {
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	MarkedAt  *time.Time `json:"markedAt"`
+	Undeleted bool       `json:"undeleted"`
+}
+
+func policyCommand(args []string) {
+	if len(args) < 2 || args[0] != "test" {
+		log.Fatal("Usage: dynamodb-backups policy test FILE...")
+	}
+
+	failed := false
+	for _, path := range args[1:] {
+		if !runPolicyTestFile(path) {
+			failed = true
+		}
+	}
+
+	if failed {
+		fmt.Println("FAIL")
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+// runPolicyTestFile runs every test case in a file against the real table
+// selection and retention code, printing results like go test.
+func runPolicyTestFile(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("FAIL\t%s\t%s\n", path, err)
+		return false
+	}
+
+	var testFile PolicyTestFile
+	err = json.Unmarshal(data, &testFile)
+	if err != nil {
+		fmt.Printf("FAIL\t%s\t%s\n", path, err)
+		return false
+	}
+
+	start := time.Now()
+	passed := true
+	for _, testCase := range testFile.Tests {
+		fmt.Printf("=== RUN   %s\n", testCase.Name)
+		caseStart := time.Now()
+
+		failures := runPolicyTestCase(testFile.Config, testCase)
+		elapsed := time.Since(caseStart).Seconds()
+		if len(failures) == 0 {
+			fmt.Printf("--- PASS: %s (%.2fs)\n", testCase.Name, elapsed)
+			continue
+		}
+
+		passed = false
+		fmt.Printf("--- FAIL: %s (%.2fs)\n", testCase.Name, elapsed)
+		for _, failure := range failures {
+			fmt.Printf("    %s\n", failure)
+		}
+	}
+
+	status := "ok  "
+	if !passed {
+		status = "FAIL"
+	}
+	fmt.Printf("%s\t%s\t%.3fs\n", status, path, time.Since(start).Seconds())
+	return passed
+}
+
+func runPolicyTestCase(fileConfig map[string]string, testCase PolicyTestCase) []string {
+	values := make(map[string]string)
+	for name, value := range fileConfig {
+		values[name] = value
+	}
+	for name, value := range testCase.Config {
+		values[name] = value
+	}
+
+	caseConfig, err := loadConfig(values)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid config: %s", err)}
+	}
+
+	// the selection and retention helpers read the global config
+	var failures []string
+	withConfig(caseConfig, func() {
+		failures = checkPolicyTestCase(testCase)
+	})
+	return failures
+}
+
+func checkPolicyTestCase(testCase PolicyTestCase) []string {
+	now := time.Now().UTC()
+	if testCase.Now != nil {
+		now = *testCase.Now
+	}
+
+	failures := make([]string, 0)
+
+	if testCase.ExpectSelected != nil {
+		patternRegex, err := regexp.Compile(config.TableRegex)
+		if err != nil {
+			return append(failures, fmt.Sprintf("invalid TABLE_REGEX: %s", err))
+		}
+		selected := matchTables(patternRegex, testCase.Tables)
+		failures = append(failures, comparePolicyResult("selected tables", testCase.ExpectSelected, selected)...)
+	}
+
+	outcomes := map[string][]string{
+		expiryKeep:    {},
+		expiryPending: {},
+		expiryDelete:  {},
+	}
+	for _, backup := range testCase.Backups {
+		var markedAt time.Time
+		if backup.MarkedAt != nil {
+			markedAt = *backup.MarkedAt
+		}
+		action := backupExpiryAction(backup.Created, markedAt, backup.Undeleted, now)
+		outcomes[action] = append(outcomes[action], backup.Name)
+	}
+
+	if testCase.ExpectKeep != nil {
+		failures = append(failures, comparePolicyResult("kept backups", testCase.ExpectKeep, outcomes[expiryKeep])...)
+	}
+	if testCase.ExpectPending != nil {
+		failures = append(failures, comparePolicyResult("pending backups", testCase.ExpectPending, outcomes[expiryPending])...)
+	}
+	if testCase.ExpectDelete != nil {
+		failures = append(failures, comparePolicyResult("deleted backups", testCase.ExpectDelete, outcomes[expiryDelete])...)
+	}
+
+	return failures
+}
+
+func comparePolicyResult(what string, expected []string, actual []string) []string {
+	expected = append([]string{}, expected...)
+	actual = append([]string{}, actual...)
+	sort.Strings(expected)
+	sort.Strings(actual)
+
+	if reflect.DeepEqual(expected, actual) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: expected %v, got %v", what, expected, actual)}
+}
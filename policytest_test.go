@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// a policy test file as an operator would write it
+const retentionPolicyTests = `{
+	"config": {"BACKUP_EXPIRE_DAYS": "7", "BACKUP_DELETE_GRACE_DAYS": "3"},
+	"tests": [
+		{
+			"name": "selection",
+			"config": {"TABLE_REGEX": "^prod-"},
+			"tables": ["prod-orders", "staging-orders", "prod-users"],
+			"expectSelected": ["prod-orders", "prod-users"]
+		},
+		{
+			"name": "grace period",
+			"now": "2024-03-20T00:00:00Z",
+			"backups": [
+				{"name": "recent", "created": "2024-03-18T00:00:00Z"},
+				{"name": "expired", "created": "2024-03-01T00:00:00Z"},
+				{"name": "marked", "created": "2024-03-01T00:00:00Z", "markedAt": "2024-03-19T00:00:00Z"},
+				{"name": "due", "created": "2024-03-01T00:00:00Z", "markedAt": "2024-03-15T00:00:00Z"}
+			],
+			"expectKeep": ["recent"],
+			"expectPending": ["expired", "marked"],
+			"expectDelete": ["due"]
+		},
+		{
+			"name": "undeleted backups are kept",
+			"now": "2024-03-20T00:00:00Z",
+			"backups": [
+				{"name": "rescued", "created": "2024-01-01T00:00:00Z", "undeleted": true},
+				{"name": "rescued after marking", "created": "2024-01-01T00:00:00Z", "markedAt": "2024-01-10T00:00:00Z", "undeleted": true},
+				{"name": "expired", "created": "2024-01-01T00:00:00Z"}
+			],
+			"expectKeep": ["rescued", "rescued after marking"],
+			"expectPending": ["expired"],
+			"expectDelete": []
+		},
+		{
+			"name": "no grace period",
+			"config": {"BACKUP_DELETE_GRACE_DAYS": "0"},
+			"now": "2024-03-20T00:00:00Z",
+			"backups": [
+				{"name": "recent", "created": "2024-03-18T00:00:00Z"},
+				{"name": "expired", "created": "2024-03-01T00:00:00Z"}
+			],
+			"expectKeep": ["recent"],
+			"expectPending": [],
+			"expectDelete": ["expired"]
+		}
+	]
+}`
+
+func TestRunPolicyTestCase(t *testing.T) {
+	var testFile PolicyTestFile
+	err := json.Unmarshal([]byte(retentionPolicyTests), &testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range testFile.Tests {
+		t.Run(testCase.Name, func(t *testing.T) {
+			for _, failure := range runPolicyTestCase(testFile.Config, testCase) {
+				t.Error(failure)
+			}
+		})
+	}
+}
+
+func TestRunPolicyTestCaseReportsFailures(t *testing.T) {
+	testCase := PolicyTestCase{
+		Name:           "wrong expectation",
+		Tables:         []string{"orders"},
+		ExpectSelected: []string{},
+	}
+
+	failures := runPolicyTestCase(map[string]string{"TABLE_REGEX": "orders"}, testCase)
+	if len(failures) != 1 {
+		t.Errorf("expected 1 failure, got %v", failures)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// Job types enqueued per table by the planner
+const (
+	jobTypeCreate = "create"
+	jobTypeExpire = "expire"
+	jobTypeVerify = "verify"
+)
+
+// Job states
+const (
+	jobStatusQueued = "queued"
+	jobStatusLeased = "leased"
+	jobStatusDone   = "done"
+	jobStatusDead   = "dead"
+)
+
+const (
+	// base delay before a failed job is retried, multiplied by its attempts
+	jobRetryBackoff = 30 * time.Second
+
+	// delay before a job that is not ready runs again, e.g. a verify job
+	// whose backup is still being created
+	jobVerifyRecheck = 30 * time.Second
+
+	// how long a verify job waits for its backup before failing
+	jobVerifyTimeout = 6 * time.Hour
+
+	// how often an idle worker checks for claimable jobs
+	jobPollInterval = 5 * time.Second
+)
+
+// errJobNotReady is returned by a job that should be retried later without
+// counting as a failed attempt
+var errJobNotReady = errors.New("job not ready")
+
+// errJobPermanent wraps errors that retrying cannot fix, dead-lettering the
+// job straight away
+var errJobPermanent = errors.New("permanent failure")
+
+// errJobLeaseExpired is recorded on a job whose lease ran out on its last
+// allowed attempt, e.g. because the worker crashed
+var errJobLeaseExpired = errors.New("lease expired")
+
+// Job Struct for a unit of work in the job queue
+type Job struct {
+	ID           string    `dynamodbav:"jobId"`
+	RunID        string    `dynamodbav:"runId"`
+	Type         string    `dynamodbav:"jobType"`
+	TableName    string    `dynamodbav:"tableName"`
+	Status       string    `dynamodbav:"status"`
+	Attempts     int       `dynamodbav:"attempts"`
+	NotBefore    time.Time `dynamodbav:"notBefore,unixtime"`
+	LeaseOwner   string    `dynamodbav:"leaseOwner,omitempty"`
+	LeaseExpires time.Time `dynamodbav:"leaseExpires,unixtime"`
+	LastError    string    `dynamodbav:"lastError,omitempty"`
+	CreatedAt    time.Time `dynamodbav:"createdAt,unixtime"`
+}
+
+// JobQueue is implemented by the job queue backends. Claim and Get return nil
+// when no job is claimable or found, and Pending counts jobs that are not
+// done or dead.
+type JobQueue interface {
+	Enqueue(job *Job) error
+	Claim(worker string, lease time.Duration) (*Job, error)
+	Complete(job *Job) error
+	Fail(job *Job, err error) error
+	Release(job *Job, delay time.Duration) error
+	Pending() (int, error)
+	Get(id string) (*Job, error)
+}
+
+func newJobQueue() (JobQueue, error) {
+	switch config.JobQueue {
+	case "memory":
+		return newMemoryJobQueue(), nil
+	case "dynamodb":
+		return newDynamoJobQueue(config.JobQueueTable, config.JobQueueIndex), nil
+	default:
+		return nil, fmt.Errorf("unknown job queue %q", config.JobQueue)
+	}
+}
+
+// runQueued plans jobs for every matched table and works the queue until it
+// is drained. With a shared queue, other `worker` processes can join in.
+func runQueued() {
+	start := time.Now()
+	runID := fmt.Sprintf("%d", start.UnixNano())
+
+	queue, err := newJobQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = planJobs(queue, runID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runWorkers(queue)
+
+	log.Info(fmt.Sprintf("Main() execution time: %s", time.Since(start)))
+}
+
+func planCommand(args []string) {
+	if config.JobQueue != "dynamodb" {
+		log.Fatal("The plan command needs a shared queue, set JOB_QUEUE=dynamodb")
+	}
+
+	queue, err := newJobQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = planJobs(queue, fmt.Sprintf("%d", time.Now().UnixNano()))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func workerCommand(args []string) {
+	if config.JobQueue != "dynamodb" {
+		log.Fatal("The worker command needs a shared queue, set JOB_QUEUE=dynamodb")
+	}
+
+	queue, err := newJobQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runWorkers(queue)
+}
+
+// planJobs enqueues create, expire and verify jobs for every matched table
+func planJobs(queue JobQueue, planRunID string) error {
+	matchedTables, err := getTablesRegex(config.TableRegex)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+
+	for _, table := range matchedTables {
+		for _, jobType := range []string{jobTypeCreate, jobTypeExpire, jobTypeVerify} {
+			job := &Job{
+				ID:        jobID(planRunID, jobType, table),
+				RunID:     planRunID,
+				Type:      jobType,
+				TableName: table,
+				Status:    jobStatusQueued,
+				NotBefore: now,
+				CreatedAt: now,
+			}
+			if jobType == jobTypeVerify {
+				job.NotBefore = now.Add(jobVerifyRecheck)
+			}
+
+			err := queue.Enqueue(job)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"runId": planRunID,
+		"count": len(matchedTables),
+		"queue": config.JobQueue,
+	}).Info(fmt.Sprintf("Planned jobs for %d tables", len(matchedTables)))
+
+	return nil
+}
+
+// runWorkers starts JOB_WORKERS workers and waits until the queue is drained
+func runWorkers(queue JobQueue) {
+	hostname, _ := os.Hostname()
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.JobWorkers; i++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			runWorker(queue, worker)
+		}(fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), i))
+	}
+	wg.Wait()
+}
+
+// runWorker claims and processes jobs until none are left pending
+func runWorker(queue JobQueue, worker string) {
+	lease := time.Duration(config.JobLeaseSeconds) * time.Second
+
+	localLogger := log.WithFields(logrus.Fields{
+		"worker": worker,
+	})
+
+	// the queue must look drained on two polls in a row, as a shared queue
+	// may count pending jobs from an eventually consistent index
+	drainedPolls := 0
+	for {
+		job, err := queue.Claim(worker, lease)
+		if err != nil {
+			localLogger.Error(err)
+			time.Sleep(jobPollInterval)
+			continue
+		}
+
+		if job == nil {
+			pending, err := queue.Pending()
+			if err != nil {
+				localLogger.Error(err)
+				drainedPolls = 0
+			} else if pending == 0 {
+				drainedPolls++
+				if drainedPolls >= 2 {
+					localLogger.Debug("Job queue drained")
+					return
+				}
+			} else {
+				drainedPolls = 0
+			}
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		drainedPolls = 0
+
+		processJob(queue, job, localLogger)
+	}
+}
+
+func processJob(queue JobQueue, job *Job, workerLogger *logrus.Entry) {
+	localLogger := workerLogger.WithFields(logrus.Fields{
+		"jobId":    job.ID,
+		"jobType":  job.Type,
+		"table":    job.TableName,
+		"attempts": job.Attempts,
+	})
+
+	var err error
+	switch job.Type {
+	case jobTypeCreate:
+		err = runCreateJob(job)
+	case jobTypeExpire:
+		err = runExpireJob(job)
+	case jobTypeVerify:
+		err = runVerifyJob(queue, job)
+	default:
+		err = fmt.Errorf("unknown job type %s", job.Type)
+	}
+
+	if err == errJobNotReady {
+		err = queue.Release(job, jobVerifyRecheck)
+	} else if err != nil {
+		localLogger.Error(err)
+		err = queue.Fail(job, err)
+		if err == nil && job.Status == jobStatusDead {
+			localLogger.Error(fmt.Sprintf("Job %s dead-lettered after %d attempts", job.ID, job.Attempts))
+			if config.TableHealthTagsEnabled {
+				writeHealthTags([]HealthResult{{TableName: job.TableName, Error: errors.New(job.LastError)}})
+			}
+		}
+	} else {
+		err = queue.Complete(job)
+
+		// the verify job knows whether the backup became available
+		if err == nil && job.Type == jobTypeVerify && config.TableHealthTagsEnabled {
+			writeHealthTags([]HealthResult{{TableName: job.TableName}})
+		}
+	}
+
+	if err != nil {
+		localLogger.Error(err)
+	}
+}
+
+// runCreateJob creates a backup for the job's table, waiting while the
+// account is at its concurrent backup quota. Consistency markers carry the
+// run ID of the plan, not of the worker that happens to run the job.
+func runCreateJob(job *Job) error {
+	available, err := backupSlotAvailable()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"table": job.TableName,
+		}).Warn(fmt.Sprintf("Could not count backups in CREATING state: %s", err))
+	} else if !available {
+		log.WithFields(logrus.Fields{
+			"table": job.TableName,
+			"quota": backupQuota,
+		}).Debug("Backup quota reached, retrying create job later")
+		return errJobNotReady
+	}
+
+	createChannel := make(chan CreateMessage, 1)
+	createBackup(job.TableName, job.RunID, createChannel)
+	createMessage := <-createChannel
+	if createMessage.Error != nil {
+		return createMessage.Error
+	}
+
+	log.WithFields(logrus.Fields{
+		"table":      createMessage.TableName,
+		"backupName": createMessage.BackupName,
+	}).Info(fmt.Sprintf("Created backup for table %s", createMessage.TableName))
+
+	return nil
+}
+
+func runExpireJob(job *Job) error {
+	expireChannel := make(chan ExpireMessage, 1)
+	expireBackups(job.TableName, expireChannel)
+	expireMessage := <-expireChannel
+	if expireMessage.Error != nil {
+		return expireMessage.Error
+	}
+
+	log.WithFields(logrus.Fields{
+		"table": expireMessage.TableName,
+		"count": expireMessage.Count,
+	}).Info(fmt.Sprintf("Deleted %d backups from table %s", expireMessage.Count, expireMessage.TableName))
+
+	reportPendingDeletions(expireMessage.Pending)
+	return nil
+}
+
+// runVerifyJob checks that the backup created for the job's run became
+// available, waiting while it is still being created. It gives up at once
+// if the create job of the run was dead-lettered.
+func runVerifyJob(queue JobQueue, job *Job) error {
+	createJobID := jobID(job.RunID, jobTypeCreate, job.TableName)
+	createJob, err := queue.Get(createJobID)
+	if err != nil {
+		return err
+	}
+	if createJob != nil && createJob.Status == jobStatusDead {
+		return fmt.Errorf("%w: create job %s is dead: %s", errJobPermanent, createJobID, createJob.LastError)
+	}
+
+	backups, err := listTableBackups(job.TableName)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].BackupCreationDateTime.After(*backups[j].BackupCreationDateTime)
+	})
+
+	timedOut := time.Since(job.CreatedAt) > jobVerifyTimeout
+	if len(backups) == 0 || backups[0].BackupCreationDateTime.Before(job.CreatedAt) {
+		if timedOut {
+			return fmt.Errorf("no backup of table %s created since %s", job.TableName, job.CreatedAt.Format(time.RFC3339))
+		}
+		return errJobNotReady
+	}
+
+	latest := backups[0]
+	switch aws.StringValue(latest.BackupStatus) {
+	case dynamodb.BackupStatusAvailable:
+		log.WithFields(logrus.Fields{
+			"table":      job.TableName,
+			"backupName": aws.StringValue(latest.BackupName),
+		}).Info(fmt.Sprintf("Verified backup for table %s", job.TableName))
+		return nil
+	case dynamodb.BackupStatusCreating:
+		if timedOut {
+			return fmt.Errorf("backup %s still creating after %s", aws.StringValue(latest.BackupName), jobVerifyTimeout)
+		}
+		return errJobNotReady
+	default:
+		return fmt.Errorf("backup %s is %s", aws.StringValue(latest.BackupName), aws.StringValue(latest.BackupStatus))
+	}
+}
+
+// jobID returns the ID of the job of a type planned for a table by a run
+func jobID(runID string, jobType string, table string) string {
+	return fmt.Sprintf("%s/%s/%s", runID, jobType, table)
+}
+
+// claimable reports whether a job may be claimed at now, either because it
+// is queued and due, or because the lease of its previous worker expired
+func (job *Job) claimable(now time.Time) bool {
+	switch job.Status {
+	case jobStatusQueued:
+		return !now.Before(job.NotBefore)
+	case jobStatusLeased:
+		return now.After(job.LeaseExpires)
+	default:
+		return false
+	}
+}
+
+// fail records a failed attempt, scheduling a retry with backoff or
+// dead-lettering the job once it has used JOB_MAX_ATTEMPTS, or at once if the
+// error is permanent
+func (job *Job) fail(err error, now time.Time) {
+	job.LastError = err.Error()
+	job.LeaseOwner = ""
+	if job.Attempts >= config.JobMaxAttempts || errors.Is(err, errJobPermanent) {
+		job.Status = jobStatusDead
+		return
+	}
+	job.Status = jobStatusQueued
+	job.NotBefore = now.Add(time.Duration(job.Attempts) * jobRetryBackoff)
+}
+
+// MemoryJobQueue is an in-process JobQueue, for running a single process
+type MemoryJobQueue struct {
+	mutex sync.Mutex
+	jobs  []*Job
+}
+
+func newMemoryJobQueue() *MemoryJobQueue {
+	return &MemoryJobQueue{
+		jobs: make([]*Job, 0),
+	}
+}
+
+// Enqueue adds a job to the queue
+func (queue *MemoryJobQueue) Enqueue(job *Job) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	copied := *job
+	queue.jobs = append(queue.jobs, &copied)
+	return nil
+}
+
+// Claim leases the first claimable job to worker
+func (queue *MemoryJobQueue) Claim(worker string, lease time.Duration) (*Job, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	now := time.Now()
+	for _, job := range queue.jobs {
+		if !job.claimable(now) {
+			continue
+		}
+		if job.Status == jobStatusLeased && job.Attempts >= config.JobMaxAttempts {
+			job.fail(errJobLeaseExpired, now)
+			continue
+		}
+		job.Status = jobStatusLeased
+		job.LeaseOwner = worker
+		job.LeaseExpires = now.Add(lease)
+		job.Attempts++
+
+		claimed := *job
+		return &claimed, nil
+	}
+	return nil, nil
+}
+
+// Complete marks a job as done
+func (queue *MemoryJobQueue) Complete(job *Job) error {
+	return queue.update(job, func(stored *Job) {
+		stored.Status = jobStatusDone
+		stored.LeaseOwner = ""
+	})
+}
+
+// Fail records a failed attempt of a job
+func (queue *MemoryJobQueue) Fail(job *Job, err error) error {
+	return queue.update(job, func(stored *Job) {
+		stored.fail(err, time.Now())
+	})
+}
+
+// Release returns a job to the queue without counting the attempt
+func (queue *MemoryJobQueue) Release(job *Job, delay time.Duration) error {
+	return queue.update(job, func(stored *Job) {
+		stored.Status = jobStatusQueued
+		stored.LeaseOwner = ""
+		stored.Attempts--
+		stored.NotBefore = time.Now().Add(delay)
+	})
+}
+
+// Pending counts jobs that are not done or dead
+func (queue *MemoryJobQueue) Pending() (int, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pending := 0
+	for _, job := range queue.jobs {
+		if job.Status == jobStatusQueued || job.Status == jobStatusLeased {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Get returns a copy of a job by ID
+func (queue *MemoryJobQueue) Get(id string) (*Job, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, stored := range queue.jobs {
+		if stored.ID == id {
+			found := *stored
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// update applies fn to the stored job if it is still leased by the worker
+// that claimed it, then copies the result back into job
+func (queue *MemoryJobQueue) update(job *Job, fn func(*Job)) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for _, stored := range queue.jobs {
+		if stored.ID != job.ID {
+			continue
+		}
+		if stored.Status != jobStatusLeased || stored.LeaseOwner != job.LeaseOwner {
+			return fmt.Errorf("job %s is no longer leased by %s", job.ID, job.LeaseOwner)
+		}
+		fn(stored)
+		*job = *stored
+		return nil
+	}
+	return fmt.Errorf("job %s not found", job.ID)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// how long finished jobs are kept in the queue table, via its TTL attribute
+const jobRetention = 7 * 24 * time.Hour
+
+// filter matching jobs that can be claimed at :now
+const claimableJobCondition = "(#status = :queued AND notBefore <= :now) OR (#status = :leased AND leaseExpires < :now)"
+
+// DynamoJobQueue is a JobQueue stored in a DynamoDB table with a string
+// partition key named jobId, shared by every worker process. The table needs
+// a global secondary index with partition key status (string) and sort key
+// notBefore (number) projecting all attributes, so that workers only read
+// jobs that are queued or leased. Enable TTL on the expiresAt attribute to
+// clean up old jobs.
+type DynamoJobQueue struct {
+	table string
+	index string
+}
+
+func newDynamoJobQueue(table string, index string) *DynamoJobQueue {
+	return &DynamoJobQueue{
+		table: table,
+		index: index,
+	}
+}
+
+// Enqueue adds a job to the queue, ignoring jobs that were already enqueued
+func (queue *DynamoJobQueue) Enqueue(job *Job) error {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+	item["expiresAt"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(job.CreatedAt.Add(jobRetention).Unix(), 10)),
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		TableName:           &queue.table,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(jobId)"),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Claim leases the first claimable job to worker. Candidates are queried
+// from the status index, due queued jobs first and then leased jobs whose
+// lease expired, and claimed with a conditional update, so that only one
+// worker wins.
+func (queue *DynamoJobQueue) Claim(worker string, lease time.Duration) (*Job, error) {
+	now := time.Now()
+	nowValue := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+
+	queries := []dynamodb.QueryInput{
+		{
+			KeyConditionExpression: aws.String("#status = :status AND notBefore <= :now"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status": {S: aws.String(jobStatusQueued)},
+				":now":    nowValue,
+			},
+		},
+		{
+			KeyConditionExpression: aws.String("#status = :status"),
+			FilterExpression:       aws.String("leaseExpires < :now"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status": {S: aws.String(jobStatusLeased)},
+				":now":    nowValue,
+			},
+		},
+	}
+
+	for _, queryInput := range queries {
+		queryInput.TableName = &queue.table
+		queryInput.IndexName = &queue.index
+		queryInput.ExpressionAttributeNames = map[string]*string{"#status": aws.String("status")}
+
+		for {
+			queryOutput, err := dynamo.Query(&queryInput)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range queryOutput.Items {
+				var candidate Job
+				err = dynamodbattribute.UnmarshalMap(item, &candidate)
+				if err != nil {
+					return nil, err
+				}
+
+				if candidate.Status == jobStatusLeased && candidate.Attempts >= config.JobMaxAttempts {
+					err = queue.Fail(&candidate, errJobLeaseExpired)
+					if err != nil && !isConditionalCheckFailed(err) {
+						return nil, err
+					}
+					continue
+				}
+
+				job, err := queue.claim(&candidate, worker, now, lease)
+				if err != nil {
+					return nil, err
+				}
+				if job != nil {
+					return job, nil
+				}
+			}
+
+			if queryOutput.LastEvaluatedKey == nil {
+				break
+			}
+			queryInput.ExclusiveStartKey = queryOutput.LastEvaluatedKey
+		}
+	}
+
+	return nil, nil
+}
+
+// claim leases a candidate job, returning nil if another worker got it first
+func (queue *DynamoJobQueue) claim(candidate *Job, worker string, now time.Time, lease time.Duration) (*Job, error) {
+	updateItemOutput, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &queue.table,
+		Key:                 jobKey(candidate),
+		UpdateExpression:    aws.String("SET #status = :leased, leaseOwner = :worker, leaseExpires = :expires, attempts = attempts + :one"),
+		ConditionExpression: aws.String("(" + claimableJobCondition + ") AND attempts = :attempts"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":queued":   {S: aws.String(jobStatusQueued)},
+			":leased":   {S: aws.String(jobStatusLeased)},
+			":now":      {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":worker":   {S: aws.String(worker)},
+			":expires":  {N: aws.String(strconv.FormatInt(now.Add(lease).Unix(), 10))},
+			":one":      {N: aws.String("1")},
+			":attempts": {N: aws.String(strconv.Itoa(candidate.Attempts))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var job Job
+	err = dynamodbattribute.UnmarshalMap(updateItemOutput.Attributes, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Complete marks a job as done
+func (queue *DynamoJobQueue) Complete(job *Job) error {
+	owner := job.LeaseOwner
+	job.Status = jobStatusDone
+	job.LeaseOwner = ""
+	return queue.update(job, owner, "SET #status = :status REMOVE leaseOwner", map[string]*dynamodb.AttributeValue{
+		":status": {S: aws.String(job.Status)},
+	})
+}
+
+// Fail records a failed attempt of a job, retrying or dead-lettering it
+func (queue *DynamoJobQueue) Fail(job *Job, err error) error {
+	owner := job.LeaseOwner
+	job.fail(err, time.Now())
+	return queue.update(job, owner, "SET #status = :status, notBefore = :notBefore, lastError = :lastError REMOVE leaseOwner", map[string]*dynamodb.AttributeValue{
+		":status":    {S: aws.String(job.Status)},
+		":notBefore": {N: aws.String(strconv.FormatInt(job.NotBefore.Unix(), 10))},
+		":lastError": {S: aws.String(job.LastError)},
+	})
+}
+
+// Release returns a job to the queue without counting the attempt
+func (queue *DynamoJobQueue) Release(job *Job, delay time.Duration) error {
+	owner := job.LeaseOwner
+	job.Status = jobStatusQueued
+	job.LeaseOwner = ""
+	job.Attempts--
+	job.NotBefore = time.Now().Add(delay)
+	return queue.update(job, owner, "SET #status = :status, notBefore = :notBefore, attempts = attempts - :one REMOVE leaseOwner", map[string]*dynamodb.AttributeValue{
+		":status":    {S: aws.String(job.Status)},
+		":notBefore": {N: aws.String(strconv.FormatInt(job.NotBefore.Unix(), 10))},
+		":one":       {N: aws.String("1")},
+	})
+}
+
+// Pending counts jobs that are not done or dead from the status index. The
+// index is eventually consistent, so the count can briefly lag behind.
+func (queue *DynamoJobQueue) Pending() (int, error) {
+	pending := 0
+	for _, status := range []string{jobStatusQueued, jobStatusLeased} {
+		queryInput := dynamodb.QueryInput{
+			TableName:                &queue.table,
+			IndexName:                &queue.index,
+			Select:                   aws.String(dynamodb.SelectCount),
+			KeyConditionExpression:   aws.String("#status = :status"),
+			ExpressionAttributeNames: map[string]*string{"#status": aws.String("status")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status": {S: aws.String(status)},
+			},
+		}
+
+		for {
+			queryOutput, err := dynamo.Query(&queryInput)
+			if err != nil {
+				return pending, err
+			}
+
+			pending += int(aws.Int64Value(queryOutput.Count))
+
+			if queryOutput.LastEvaluatedKey == nil {
+				break
+			}
+			queryInput.ExclusiveStartKey = queryOutput.LastEvaluatedKey
+		}
+	}
+	return pending, nil
+}
+
+// Get returns a job by ID
+func (queue *DynamoJobQueue) Get(id string) (*Job, error) {
+	getItemOutput, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		TableName:      &queue.table,
+		Key:            jobKey(&Job{ID: id}),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(getItemOutput.Item) == 0 {
+		return nil, nil
+	}
+
+	var job Job
+	err = dynamodbattribute.UnmarshalMap(getItemOutput.Item, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// update applies an update expression to a job, on condition that it is
+// still leased by owner
+func (queue *DynamoJobQueue) update(job *Job, owner string, updateExpression string, values map[string]*dynamodb.AttributeValue) error {
+	values[":leased"] = &dynamodb.AttributeValue{S: aws.String(jobStatusLeased)}
+	values[":owner"] = &dynamodb.AttributeValue{S: aws.String(owner)}
+
+	_, err := dynamo.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &queue.table,
+		Key:                 jobKey(job),
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String("#status = :leased AND leaseOwner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+func jobKey(job *Job) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"jobId": {S: aws.String(job.ID)},
+	}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
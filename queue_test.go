@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// withQueueConfig runs a test against the defaults with JOB_MAX_ATTEMPTS=3
+func withQueueConfig(t *testing.T) {
+	queueConfig, err := loadConfig(map[string]string{"JOB_MAX_ATTEMPTS": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := config
+	config = queueConfig
+	t.Cleanup(func() { config = previous })
+}
+
+func enqueueTestJob(t *testing.T, queue *MemoryJobQueue, jobType string) *Job {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        jobID("run", jobType, "orders"),
+		RunID:     "run",
+		Type:      jobType,
+		TableName: "orders",
+		Status:    jobStatusQueued,
+		NotBefore: now,
+		CreatedAt: now,
+	}
+	err := queue.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func mustClaim(t *testing.T, queue *MemoryJobQueue, worker string, lease time.Duration) *Job {
+	t.Helper()
+	job, err := queue.Claim(worker, lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil {
+		t.Fatalf("expected %s to claim a job", worker)
+	}
+	return job
+}
+
+func TestMemoryJobQueueLease(t *testing.T) {
+	withQueueConfig(t)
+	queue := newMemoryJobQueue()
+	enqueueTestJob(t, queue, jobTypeExpire)
+
+	first := mustClaim(t, queue, "worker-a", time.Millisecond)
+	if first.Status != jobStatusLeased || first.LeaseOwner != "worker-a" || first.Attempts != 1 {
+		t.Errorf("unexpected claimed job %+v", first)
+	}
+
+	if job, _ := queue.Claim("worker-b", time.Minute); job != nil {
+		t.Fatal("expected a leased job not to be claimable before its lease expires")
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	second := mustClaim(t, queue, "worker-b", time.Minute)
+	if second.LeaseOwner != "worker-b" || second.Attempts != 2 {
+		t.Errorf("expected worker-b to reclaim the job on attempt 2, got %+v", second)
+	}
+
+	if err := queue.Complete(first); err == nil {
+		t.Error("expected the worker whose lease expired not to complete the job")
+	}
+	if err := queue.Complete(second); err != nil {
+		t.Fatal(err)
+	}
+	if second.Status != jobStatusDone {
+		t.Errorf("expected the job to be done, got %s", second.Status)
+	}
+
+	pending, _ := queue.Pending()
+	if pending != 0 {
+		t.Errorf("expected no pending jobs, got %d", pending)
+	}
+}
+
+func TestMemoryJobQueueLeaseExpiredOnLastAttempt(t *testing.T) {
+	withQueueConfig(t)
+	queue := newMemoryJobQueue()
+	enqueued := enqueueTestJob(t, queue, jobTypeExpire)
+
+	for i := 0; i < config.JobMaxAttempts; i++ {
+		mustClaim(t, queue, "crashing-worker", time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	job, err := queue.Claim("worker", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job != nil {
+		t.Fatalf("expected no claimable job, got %+v", job)
+	}
+
+	stored, _ := queue.Get(enqueued.ID)
+	if stored.Status != jobStatusDead || stored.LastError != errJobLeaseExpired.Error() {
+		t.Errorf("expected the job to be dead-lettered with a lease error, got %+v", stored)
+	}
+}
+
+func TestMemoryJobQueueFail(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		failures       int
+		expectStatus   string
+		expectAttempts int
+	}{
+		{
+			name:           "retried with backoff",
+			err:            errors.New("throttled"),
+			failures:       1,
+			expectStatus:   jobStatusQueued,
+			expectAttempts: 1,
+		},
+		{
+			name:           "dead-lettered at JOB_MAX_ATTEMPTS",
+			err:            errors.New("throttled"),
+			failures:       3,
+			expectStatus:   jobStatusDead,
+			expectAttempts: 3,
+		},
+		{
+			name:           "permanent error dead-lettered at once",
+			err:            fmt.Errorf("%w: table deleted", errJobPermanent),
+			failures:       1,
+			expectStatus:   jobStatusDead,
+			expectAttempts: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			withQueueConfig(t)
+			queue := newMemoryJobQueue()
+			enqueued := enqueueTestJob(t, queue, jobTypeExpire)
+
+			for i := 0; i < testCase.failures; i++ {
+				// skip the backoff of the previous failure
+				queue.jobs[0].NotBefore = time.Time{}
+
+				job := mustClaim(t, queue, "worker", time.Minute)
+				failedAt := time.Now()
+				err := queue.Fail(job, testCase.err)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if job.Status == jobStatusQueued {
+					backoff := job.NotBefore.Sub(failedAt)
+					expected := time.Duration(job.Attempts) * jobRetryBackoff
+					if backoff < expected || backoff > expected+time.Second {
+						t.Errorf("expected a retry after %s, got %s", expected, backoff)
+					}
+					if claimed, _ := queue.Claim("worker", time.Minute); claimed != nil {
+						t.Error("expected the job not to be claimable during its backoff")
+					}
+				}
+			}
+
+			stored, _ := queue.Get(enqueued.ID)
+			if stored.Status != testCase.expectStatus || stored.Attempts != testCase.expectAttempts {
+				t.Errorf("expected %s after %d attempts, got %s after %d", testCase.expectStatus, testCase.expectAttempts, stored.Status, stored.Attempts)
+			}
+			if stored.LastError != testCase.err.Error() {
+				t.Errorf("expected last error %q, got %q", testCase.err, stored.LastError)
+			}
+		})
+	}
+}
+
+func TestMemoryJobQueueRelease(t *testing.T) {
+	withQueueConfig(t)
+	queue := newMemoryJobQueue()
+	enqueued := enqueueTestJob(t, queue, jobTypeVerify)
+
+	job := mustClaim(t, queue, "worker", time.Minute)
+	err := queue.Release(job, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := queue.Get(enqueued.ID)
+	if stored.Status != jobStatusQueued || stored.Attempts != 0 || stored.LeaseOwner != "" {
+		t.Errorf("expected the attempt to be refunded and the lease dropped, got %+v", stored)
+	}
+	if claimed, _ := queue.Claim("worker", time.Minute); claimed != nil {
+		t.Error("expected a released job not to be claimable before its delay")
+	}
+	if err := queue.Complete(job); err == nil {
+		t.Error("expected a released job not to be completed by its previous worker")
+	}
+}
+
+func TestRunVerifyJobDeadCreateJob(t *testing.T) {
+	withQueueConfig(t)
+	queue := newMemoryJobQueue()
+	enqueueTestJob(t, queue, jobTypeCreate)
+	enqueued := enqueueTestJob(t, queue, jobTypeVerify)
+
+	create := mustClaim(t, queue, "worker", time.Minute)
+	err := queue.Fail(create, fmt.Errorf("%w: table not found", errJobPermanent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the verify job fails before it lists backups, so no client is needed
+	verify := mustClaim(t, queue, "worker", time.Minute)
+	processJob(queue, verify, log)
+
+	stored, _ := queue.Get(enqueued.ID)
+	if stored.Status != jobStatusDead || stored.Attempts != 1 {
+		t.Errorf("expected the verify job to be dead-lettered on its first attempt, got %+v", stored)
+	}
+}
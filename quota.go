@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// service code of DynamoDB in the Service Quotas API
+	dynamodbServiceCode = "dynamodb"
+
+	// how often a quota-bound run checks whether a backup finished creating
+	backupPollInterval = 5 * time.Second
+
+	// how far back to look for backups that may still be creating
+	creatingBackupsLookback = 24 * time.Hour
+)
+
+// getCreateConcurrency returns how many backups this run may create at once,
+// and whether that is fewer than the number of tables (the run is quota-bound)
+func getCreateConcurrency(tableCount int) (int, bool) {
+	limit := getBackupQuota()
+
+	creating, err := countCreatingBackups()
+	if err != nil {
+		log.Warn(fmt.Sprintf("Could not count backups in CREATING state: %s", err))
+	}
+
+	available := limit - creating
+	if available < 1 {
+		available = 1
+	}
+
+	quotaBound := available < tableCount
+	concurrency := available
+	if !quotaBound && tableCount > 0 {
+		concurrency = tableCount
+	}
+
+	logger := log.WithFields(logrus.Fields{
+		"quota":       limit,
+		"creating":    creating,
+		"concurrency": concurrency,
+		"count":       tableCount,
+	})
+	if quotaBound {
+		logger.Warn(fmt.Sprintf("Run is quota-bound, creating at most %d backups at a time", concurrency))
+	} else {
+		logger.Debug("Backup concurrency")
+	}
+
+	return concurrency, quotaBound
+}
+
+// backupQuota caches the concurrent backup limit for queue workers
+var (
+	backupQuota     int
+	backupQuotaOnce sync.Once
+)
+
+// backupSlotAvailable reports whether the account has room for another
+// backup under the concurrent backup quota. Queue workers on every host share
+// the quota, so it is checked against the backups already creating instead of
+// slots held in this process.
+func backupSlotAvailable() (bool, error) {
+	backupQuotaOnce.Do(func() {
+		backupQuota = getBackupQuota()
+	})
+
+	creating, err := countCreatingBackups()
+	if err != nil {
+		return false, err
+	}
+	return creating < backupQuota, nil
+}
+
+// getBackupQuota looks up the concurrent backup limit in Service Quotas,
+// falling back to BACKUP_CONCURRENCY_FALLBACK if it can't be found.
+func getBackupQuota() int {
+	value, err := findBackupQuota(func(fn func([]*servicequotas.ServiceQuota)) error {
+		input := &servicequotas.ListServiceQuotasInput{ServiceCode: aws.String(dynamodbServiceCode)}
+		return serviceQuotas.ListServiceQuotasPages(input,
+			func(page *servicequotas.ListServiceQuotasOutput, lastPage bool) bool {
+				fn(page.Quotas)
+				return !lastPage
+			})
+	})
+	if err == nil && value == 0 {
+		value, err = findBackupQuota(func(fn func([]*servicequotas.ServiceQuota)) error {
+			input := &servicequotas.ListAWSDefaultServiceQuotasInput{ServiceCode: aws.String(dynamodbServiceCode)}
+			return serviceQuotas.ListAWSDefaultServiceQuotasPages(input,
+				func(page *servicequotas.ListAWSDefaultServiceQuotasOutput, lastPage bool) bool {
+					fn(page.Quotas)
+					return !lastPage
+				})
+		})
+	}
+
+	if err != nil {
+		log.Warn(fmt.Sprintf("Could not read backup quota, using fallback of %d: %s", config.BackupConcurrencyFallback, err))
+		return config.BackupConcurrencyFallback
+	}
+	if value == 0 {
+		log.Warn(fmt.Sprintf("No backup quota found, using fallback of %d", config.BackupConcurrencyFallback))
+		return config.BackupConcurrencyFallback
+	}
+	return value
+}
+
+// findBackupQuota scans quota pages for BACKUP_QUOTA_CODE, or when that is
+// unset for a quota on concurrent backups, returning 0 if there is none.
+func findBackupQuota(listQuotas func(func([]*servicequotas.ServiceQuota)) error) (int, error) {
+	value := 0
+	err := listQuotas(func(quotas []*servicequotas.ServiceQuota) {
+		for _, quota := range quotas {
+			if value != 0 || quota.Value == nil {
+				continue
+			}
+
+			if config.BackupQuotaCode != "" {
+				if aws.StringValue(quota.QuotaCode) == config.BackupQuotaCode {
+					value = int(*quota.Value)
+				}
+				continue
+			}
+
+			name := strings.ToLower(aws.StringValue(quota.QuotaName))
+			if strings.Contains(name, "concurrent") && strings.Contains(name, "backup") {
+				value = int(*quota.Value)
+			}
+		}
+	})
+	return value, err
+}
+
+// countCreatingBackups returns the number of backups in the account that are
+// still being created, as they count against the concurrency quota
+func countCreatingBackups() (int, error) {
+	lowerBound := time.Now().Add(-creatingBackupsLookback)
+	listBackupsInput := dynamodb.ListBackupsInput{
+		BackupType:          aws.String(dynamodb.BackupTypeFilterUser),
+		TimeRangeLowerBound: &lowerBound,
+	}
+
+	creating := 0
+	for {
+		listBackupsOutput, err := dynamo.ListBackups(&listBackupsInput)
+		if err != nil {
+			return creating, err
+		}
+
+		for _, backupSummary := range listBackupsOutput.BackupSummaries {
+			if aws.StringValue(backupSummary.BackupStatus) == dynamodb.BackupStatusCreating {
+				creating++
+			}
+		}
+
+		if listBackupsOutput.LastEvaluatedBackupArn == nil {
+			return creating, nil
+		}
+		listBackupsInput.ExclusiveStartBackupArn = listBackupsOutput.LastEvaluatedBackupArn
+	}
+}
+
+// createBackupWithSlot creates a backup once a slot is free. When the run is
+// quota-bound the slot is held until the backup has finished creating.
+func createBackupWithSlot(table string, runID string, createSlots chan struct{}, quotaBound bool, createChannel chan CreateMessage) {
+	createSlots <- struct{}{}
+
+	resultChannel := make(chan CreateMessage, 1)
+	createBackup(table, runID, resultChannel)
+	createMessage := <-resultChannel
+
+	if quotaBound && createMessage.Error == nil {
+		waitForBackup(table, createMessage.BackupArn)
+	}
+
+	<-createSlots
+	createChannel <- createMessage
+}
+
+// waitForBackup polls a backup until it leaves the CREATING state
+func waitForBackup(table string, backupArn string) {
+	localLogger := log.WithFields(logrus.Fields{
+		"table":     table,
+		"backupArn": backupArn,
+		"action":    "waitForBackup",
+	})
+
+	describeBackupInput := dynamodb.DescribeBackupInput{
+		BackupArn: &backupArn,
+	}
+
+	for {
+		describeBackupOutput, err := dynamo.DescribeBackup(&describeBackupInput)
+		if err != nil {
+			localLogger.Error(err)
+			return
+		}
+
+		status := aws.StringValue(describeBackupOutput.BackupDescription.BackupDetails.BackupStatus)
+		if status != dynamodb.BackupStatusCreating {
+			localLogger.Debug(fmt.Sprintf("Backup is %s", status))
+			return
+		}
+
+		time.Sleep(backupPollInterval)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// size in pixels of the charts drawn in the report, matching the template
+const (
+	reportChartWidth = 600
+	reportSizeHeight = 60
+)
+
+// HTMLReport Struct holding the data rendered into the HTML report
+type HTMLReport struct {
+	GeneratedAt    time.Time
+	Days           int
+	HistoryDays    int
+	RPOHours       int
+	Tables         []ReportTable
+	CompliantCount int
+	TotalSizeBytes int64
+}
+
+// ReportTable Struct holding the report data for a single table
+type ReportTable struct {
+	TableName       string
+	BackupCount     int
+	LatestBackup    time.Time
+	RPOCompliant    bool
+	SuccessRate     float64
+	TotalSizeBytes  int64
+	LatestSizeBytes int64
+	Timeline        []ReportPoint
+	SizePoints      string
+	Failures        []string
+}
+
+// ReportPoint Struct for a backup drawn on a table's timeline
+type ReportPoint struct {
+	X      float64
+	Status string
+	Title  string
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+	"date":  func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04") },
+	"lower": strings.ToLower,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>DynamoDB backup compliance report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+.ok { color: #2a7d2a; }
+.fail { color: #b22222; }
+svg { background: #fafafa; border: 1px solid #ddd; }
+circle.available { fill: #2a7d2a; }
+circle.creating { fill: #d4a017; }
+circle.deleted { fill: #b22222; }
+polyline { fill: none; stroke: #1f5fa8; stroke-width: 2; }
+</style>
+</head>
+<body>
+<h1>DynamoDB backup compliance report</h1>
+<p>Generated {{ date .GeneratedAt }} UTC from live ListBackups data, covering the last {{ .HistoryDays }} days.
+RPO target: a backup no older than {{ .RPOHours }} hours.</p>
+{{- if lt .HistoryDays .Days }}
+<p>{{ .Days }} days were requested, but backups are deleted after BACKUP_EXPIRE_DAYS plus the deletion grace period,
+so live data only goes back {{ .HistoryDays }} days. Success rates, failures, timelines and storage growth cover that period.</p>
+{{- end }}
+
+<h2>Summary</h2>
+<table>
+<tr><th>Tables</th><td>{{ len .Tables }}</td></tr>
+<tr><th>RPO compliant</th><td>{{ .CompliantCount }} of {{ len .Tables }}</td></tr>
+<tr><th>Backup storage</th><td>{{ bytes .TotalSizeBytes }}</td></tr>
+</table>
+
+<h2>Tables</h2>
+<table>
+<tr><th>Table</th><th>Latest backup</th><th>RPO</th><th>Days with a backup</th><th>Backups</th><th>Storage</th></tr>
+{{- range .Tables }}
+<tr>
+<td><a href="#{{ .TableName }}">{{ .TableName }}</a></td>
+<td>{{ if .LatestBackup.IsZero }}never{{ else }}{{ date .LatestBackup }}{{ end }}</td>
+<td>{{ if .RPOCompliant }}<span class="ok">met</span>{{ else }}<span class="fail">missed</span>{{ end }}</td>
+<td>{{ printf "%.0f" .SuccessRate }}%</td>
+<td>{{ .BackupCount }}</td>
+<td>{{ bytes .TotalSizeBytes }}</td>
+</tr>
+{{- end }}
+</table>
+{{ range .Tables }}
+<h3 id="{{ .TableName }}">{{ .TableName }}</h3>
+<p>Backup timeline</p>
+<svg width="600" height="24" viewBox="0 0 600 24">
+{{- range .Timeline }}
+<circle class="{{ lower .Status }}" cx="{{ .X }}" cy="12" r="4"><title>{{ .Title }}</title></circle>
+{{- end }}
+</svg>
+<p>Backup size (latest {{ bytes .LatestSizeBytes }})</p>
+<svg width="600" height="60" viewBox="0 0 600 60">
+<polyline points="{{ .SizePoints }}"/>
+</svg>
+{{- if .Failures }}
+<p>Recent failures</p>
+<ul>
+{{- range .Failures }}
+<li class="fail">{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+{{ end }}
+</body>
+</html>
+`))
+
+func reportCommand(args []string) {
+	if len(args) < 1 || args[0] != "html" {
+		log.Fatal("Usage: dynamodb-backups report html [-output FILE] [-days N] [-rpo-hours N] [TABLE...]")
+	}
+
+	flags := flag.NewFlagSet("report html", flag.ExitOnError)
+	output := flags.String("output", "backup-report.html", "file to write the report to")
+	days := flags.Int("days", 30, "number of days covered by the report")
+	rpoHours := flags.Int("rpo-hours", 24, "maximum age of the latest backup")
+	flags.Parse(args[1:])
+
+	tables := flags.Args()
+	if len(tables) == 0 {
+		var err error
+		tables, err = getTablesRegex(config.TableRegex)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report := &HTMLReport{
+		GeneratedAt: time.Now().UTC(),
+		Days:        *days,
+		HistoryDays: reportHistoryDays(*days),
+		RPOHours:    *rpoHours,
+		Tables:      make([]ReportTable, 0, len(tables)),
+	}
+	if report.HistoryDays < report.Days {
+		log.WithFields(logrus.Fields{
+			"days":        report.Days,
+			"historyDays": report.HistoryDays,
+		}).Warn(fmt.Sprintf("Backups are only kept for %d days, limiting the report to them", report.HistoryDays))
+	}
+
+	for _, table := range tables {
+		backups, err := listTableBackups(table)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"table":  table,
+				"action": "reportCommand",
+			}).Error(err)
+			continue
+		}
+
+		reportTable := getReportTable(table, backups, report.GeneratedAt, report.HistoryDays, *rpoHours)
+		if reportTable.RPOCompliant {
+			report.CompliantCount++
+		}
+		report.TotalSizeBytes += reportTable.TotalSizeBytes
+		report.Tables = append(report.Tables, reportTable)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	err = reportTemplate.Execute(file, report)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.WithFields(logrus.Fields{
+		"path":  *output,
+		"count": len(report.Tables),
+	}).Info(fmt.Sprintf("Wrote HTML report for %d tables", len(report.Tables)))
+}
+
+// reportHistoryDays limits the days covered by the report to the retention
+// horizon, as older backups have already been deleted by this tool
+func reportHistoryDays(days int) int {
+	horizon := config.BackupExpireDays + config.BackupDeleteGraceDays
+	if horizon < 1 {
+		horizon = 1
+	}
+	if days > horizon {
+		return horizon
+	}
+	return days
+}
+
+// getReportTable summarizes the backups of a table over the report window
+func getReportTable(table string, backups []*dynamodb.BackupSummary, now time.Time, days int, rpoHours int) ReportTable {
+	windowStart := now.AddDate(0, 0, -days)
+	window := now.Sub(windowStart)
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].BackupCreationDateTime.Before(*backups[j].BackupCreationDateTime)
+	})
+
+	reportTable := ReportTable{
+		TableName: table,
+		Timeline:  make([]ReportPoint, 0),
+		Failures:  make([]string, 0),
+	}
+
+	var maxSize int64
+	sizes := make([]*dynamodb.BackupSummary, 0)
+
+	for _, backup := range backups {
+		created := aws.TimeValue(backup.BackupCreationDateTime)
+		status := aws.StringValue(backup.BackupStatus)
+		size := aws.Int64Value(backup.BackupSizeBytes)
+
+		reportTable.TotalSizeBytes += size
+		if status == dynamodb.BackupStatusAvailable && created.After(reportTable.LatestBackup) {
+			reportTable.LatestBackup = created
+			reportTable.LatestSizeBytes = size
+		}
+
+		if created.Before(windowStart) {
+			continue
+		}
+		reportTable.BackupCount++
+
+		reportTable.Timeline = append(reportTable.Timeline, ReportPoint{
+			X:      float64(created.Sub(windowStart)) / float64(window) * reportChartWidth,
+			Status: status,
+			Title:  fmt.Sprintf("%s %s %s", aws.StringValue(backup.BackupName), status, formatBytes(size)),
+		})
+
+		if status == dynamodb.BackupStatusAvailable {
+			sizes = append(sizes, backup)
+			if size > maxSize {
+				maxSize = size
+			}
+		} else if status == dynamodb.BackupStatusDeleted {
+			reportTable.Failures = append(reportTable.Failures,
+				fmt.Sprintf("%s: backup %s was deleted", created.UTC().Format("2006-01-02"), aws.StringValue(backup.BackupName)))
+		}
+	}
+
+	// 24 hour periods, counted back from now, without a backup count as
+	// failed runs
+	successDays := 0
+	for day := 0; day < days; day++ {
+		periodEnd := now.AddDate(0, 0, -day)
+		periodStart := periodEnd.AddDate(0, 0, -1)
+		found := false
+		for _, backup := range sizes {
+			if backup.BackupCreationDateTime.After(periodStart) && !backup.BackupCreationDateTime.After(periodEnd) {
+				found = true
+				break
+			}
+		}
+		if found {
+			successDays++
+		} else {
+			reportTable.Failures = append(reportTable.Failures,
+				fmt.Sprintf("%s: no backup in the previous 24 hours", periodEnd.UTC().Format("2006-01-02 15:04")))
+		}
+	}
+	if days > 0 {
+		reportTable.SuccessRate = float64(successDays) / float64(days) * 100
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(reportTable.Failures)))
+
+	reportTable.RPOCompliant = !reportTable.LatestBackup.IsZero() &&
+		now.Sub(reportTable.LatestBackup) <= time.Duration(rpoHours)*time.Hour
+
+	points := make([]string, 0, len(sizes))
+	for _, backup := range sizes {
+		x := float64(backup.BackupCreationDateTime.Sub(windowStart)) / float64(window) * reportChartWidth
+		y := float64(reportSizeHeight)
+		if maxSize > 0 {
+			y = reportSizeHeight - float64(aws.Int64Value(backup.BackupSizeBytes))/float64(maxSize)*(reportSizeHeight-4) - 2
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	reportTable.SizePoints = strings.Join(points, " ")
+
+	return reportTable
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sirupsen/logrus"
+)
+
+// number of most recent backups listed in a runbook
+const runbookBackupCount = 5
+
+// Runbook Struct holding everything needed to render a table restore runbook
+type Runbook struct {
+	TableName   string
+	GeneratedAt time.Time
+	Table       *dynamodb.TableDescription
+	BillingMode string
+	Backups     []*dynamodb.BackupSummary
+	PITR        *dynamodb.PointInTimeRecoveryDescription
+	TTL         *dynamodb.TimeToLiveDescription
+	Tags        []*dynamodb.Tag
+}
+
+var runbookTemplate = template.Must(template.New("runbook").Funcs(template.FuncMap{
+	"str":  aws.StringValue,
+	"i64":  aws.Int64Value,
+	"date": func(t *time.Time) string { return aws.TimeValue(t).UTC().Format(time.RFC3339) },
+}).Parse(`# Restore runbook: {{ .TableName }}
+
+Generated {{ .GeneratedAt.Format "2006-01-02T15:04:05Z07:00" }} by dynamodb-backups.
+
+## Latest backups
+{{ if .Backups }}
+| Name | Created | Status | Size (bytes) | ARN |
+|------|---------|--------|--------------|-----|
+{{- range .Backups }}
+| {{ str .BackupName }} | {{ date .BackupCreationDateTime }} | {{ str .BackupStatus }} | {{ i64 .BackupSizeBytes }} | {{ str .BackupArn }} |
+{{- end }}
+{{ else }}
+No backups found for this table.
+{{ end }}
+## Point-in-time recovery
+{{ if and .PITR (eq (str .PITR.PointInTimeRecoveryStatus) "ENABLED") }}
+PITR is enabled. Restorable window:
+
+- Earliest: {{ date .PITR.EarliestRestorableDateTime }}
+- Latest: {{ date .PITR.LatestRestorableDateTime }}
+{{ else }}
+PITR is not enabled for this table; only the backups above can be restored.
+{{ end }}
+## Restore commands
+
+Restores always create a new table. Restore the latest backup:
+
+` + "```" + `sh
+{{- if .Backups }}
+aws dynamodb restore-table-from-backup \
+    --target-table-name {{ .TableName }}-restored \
+    --backup-arn {{ str (index .Backups 0).BackupArn }}
+{{- else }}
+# no backup available
+{{- end }}
+aws dynamodb wait table-exists --table-name {{ .TableName }}-restored
+` + "```" + `
+{{ if and .PITR (eq (str .PITR.PointInTimeRecoveryStatus) "ENABLED") }}
+Restore to a point in time within the PITR window:
+
+` + "```" + `sh
+aws dynamodb restore-table-to-point-in-time \
+    --source-table-name {{ .TableName }} \
+    --target-table-name {{ .TableName }}-restored \
+    --restore-date-time <RFC3339 timestamp>
+` + "```" + `
+{{ end }}
+## Table settings
+
+Restored tables keep the key schema, indexes, billing mode and encryption of
+the backup. Streams, time to live, PITR, auto scaling and tags are not
+restored and must be reapplied by hand. Current settings:
+
+- Key schema:{{ range .Table.KeySchema }} {{ str .AttributeName }} ({{ str .KeyType }}){{ end }}
+- Billing mode: {{ .BillingMode }}
+{{- if and (eq .BillingMode "PROVISIONED") .Table.ProvisionedThroughput }}
+- Provisioned throughput: {{ i64 .Table.ProvisionedThroughput.ReadCapacityUnits }} RCU / {{ i64 .Table.ProvisionedThroughput.WriteCapacityUnits }} WCU (auto scaling policies are not restored)
+{{- end }}
+{{- if .Table.StreamSpecification }}
+- Stream: {{ str .Table.StreamSpecification.StreamViewType }}
+{{- end }}
+{{- if and .TTL (eq (str .TTL.TimeToLiveStatus) "ENABLED") }}
+- Time to live attribute: {{ str .TTL.AttributeName }}
+{{- end }}
+- PITR: {{ if and .PITR (eq (str .PITR.PointInTimeRecoveryStatus) "ENABLED") }}enable again{{ else }}disabled{{ end }}
+{{- range .Table.GlobalSecondaryIndexes }}
+- Global secondary index {{ str .IndexName }} (restored with the table)
+{{- end }}
+{{- range .Tags }}
+- Tag {{ str .Key }}={{ str .Value }}
+{{- end }}
+`))
+
+// writeRunbooks generates a Markdown restore runbook for every table given on
+// the command line, or every table matching TABLE_REGEX if none are given.
+func writeRunbooks(args []string) {
+	flags := flag.NewFlagSet("runbook", flag.ExitOnError)
+	outputDir := flags.String("output", "runbooks", "directory to write runbooks to")
+	flags.Parse(args)
+
+	tables := flags.Args()
+	if len(tables) == 0 {
+		var err error
+		tables, err = getTablesRegex(config.TableRegex)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err := os.MkdirAll(*outputDir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, table := range tables {
+		localLogger := log.WithFields(logrus.Fields{
+			"table":  table,
+			"action": "writeRunbook",
+		})
+
+		runbook, err := getRunbook(table)
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+
+		path := filepath.Join(*outputDir, fmt.Sprintf("%s.md", table))
+		file, err := os.Create(path)
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+
+		err = runbookTemplate.Execute(file, runbook)
+		file.Close()
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+
+		localLogger.WithFields(logrus.Fields{
+			"path": path,
+		}).Info(fmt.Sprintf("Wrote runbook for table %s", table))
+	}
+}
+
+func getRunbook(table string) (*Runbook, error) {
+	describeTableOutput, err := dynamo.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	continuousBackupsOutput, err := dynamo.DescribeContinuousBackups(&dynamodb.DescribeContinuousBackupsInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timeToLiveOutput, err := dynamo.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: &table,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := listResourceTags(describeTableOutput.Table.TableArn)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := listTableBackups(table)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].BackupCreationDateTime.After(*backups[j].BackupCreationDateTime)
+	})
+	if len(backups) > runbookBackupCount {
+		backups = backups[:runbookBackupCount]
+	}
+
+	runbook := &Runbook{
+		TableName:   table,
+		GeneratedAt: time.Now().UTC(),
+		Table:       describeTableOutput.Table,
+		BillingMode: dynamodb.BillingModeProvisioned,
+		Backups:     backups,
+		TTL:         timeToLiveOutput.TimeToLiveDescription,
+		Tags:        tags,
+	}
+	if describeTableOutput.Table.BillingModeSummary != nil {
+		runbook.BillingMode = aws.StringValue(describeTableOutput.Table.BillingModeSummary.BillingMode)
+	}
+	if continuousBackupsOutput.ContinuousBackupsDescription != nil {
+		runbook.PITR = continuousBackupsOutput.ContinuousBackupsDescription.PointInTimeRecoveryDescription
+	}
+
+	return runbook, nil
+}
+
+// listTableBackups returns every backup of a table, following pagination
+func listTableBackups(table string) ([]*dynamodb.BackupSummary, error) {
+	backups := make([]*dynamodb.BackupSummary, 0)
+	listBackupsInput := dynamodb.ListBackupsInput{
+		TableName: &table,
+	}
+
+	for {
+		listBackupsOutput, err := dynamo.ListBackups(&listBackupsInput)
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, listBackupsOutput.BackupSummaries...)
+
+		if listBackupsOutput.LastEvaluatedBackupArn == nil {
+			return backups, nil
+		}
+		listBackupsInput.ExclusiveStartBackupArn = listBackupsOutput.LastEvaluatedBackupArn
+	}
+}
+
+// listResourceTags returns every tag of a table, following pagination
+func listResourceTags(resourceArn *string) ([]*dynamodb.Tag, error) {
+	tags := make([]*dynamodb.Tag, 0)
+	listTagsInput := dynamodb.ListTagsOfResourceInput{
+		ResourceArn: resourceArn,
+	}
+
+	for {
+		listTagsOutput, err := dynamo.ListTagsOfResource(&listTagsInput)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, listTagsOutput.Tags...)
+
+		if listTagsOutput.NextToken == nil {
+			return tags, nil
+		}
+		listTagsInput.NextToken = listTagsOutput.NextToken
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/sirupsen/logrus"
+)
+
+// PendingDeletion Struct describing a backup marked for deletion, stored in
+// PENDING_DELETION_TABLE while it waits out the grace period. UndeletedAt is
+// set when an operator rescued the backup, which then is never expired.
+type PendingDeletion struct {
+	BackupArn   string     `dynamodbav:"backupArn"`
+	TableName   string     `dynamodbav:"tableName"`
+	BackupName  string     `dynamodbav:"backupName"`
+	Reason      string     `dynamodbav:"reason"`
+	MarkedAt    time.Time  `dynamodbav:"markedAt,unixtime"`
+	UndeletedAt *time.Time `dynamodbav:"undeletedAt,unixtime,omitempty"`
+	DeleteAfter time.Time  `dynamodbav:"-"`
+}
+
+// expireBackup applies the expiry decision of a run at now to a backup.
+// With a grace period, an expired backup is first marked as pending deletion
+// and only deleted once it has been marked for longer than the grace period.
+// On-demand backups cannot be tagged, so marks are kept in
+// PENDING_DELETION_TABLE, a table with a string partition key named
+// backupArn.
+func expireBackup(backupSummary *dynamodb.BackupSummary, now time.Time, deleteChannel chan DeleteMessage) {
+	localLogger := log.WithFields(logrus.Fields{
+		"backupName": *backupSummary.BackupName,
+		"table":      *backupSummary.TableName,
+		"action":     "expireBackup",
+	})
+
+	var mark PendingDeletion
+	var err error
+	if config.BackupDeleteGraceDays > 0 {
+		mark, err = getPendingDeletionMark(backupSummary.BackupArn)
+		if err != nil {
+			localLogger.Error(err)
+			deleteChannel <- DeleteMessage{
+				TableName:  *backupSummary.TableName,
+				BackupName: *backupSummary.BackupName,
+				Error:      err,
+			}
+			return
+		}
+	}
+
+	markedAt := mark.MarkedAt
+	undeleted := mark.UndeletedAt != nil
+	switch backupExpiryAction(aws.TimeValue(backupSummary.BackupCreationDateTime), markedAt, undeleted, now) {
+	case expiryKeep:
+		deleteChannel <- DeleteMessage{
+			TableName:  *backupSummary.TableName,
+			BackupName: *backupSummary.BackupName,
+			Kept:       true,
+		}
+		return
+	case expiryDelete:
+		if markedAt.IsZero() {
+			deleteBackup(backupSummary, deleteChannel)
+		} else {
+			deleteMarkedBackup(backupSummary, deleteChannel)
+		}
+		return
+	}
+
+	if markedAt.IsZero() {
+		localLogger.Info(fmt.Sprintf("Marking backup for table %s as pending deletion", *backupSummary.TableName))
+		markedAt, err = markPendingDeletion(&PendingDeletion{
+			BackupArn:  *backupSummary.BackupArn,
+			TableName:  *backupSummary.TableName,
+			BackupName: *backupSummary.BackupName,
+			Reason:     fmt.Sprintf("older than %d days", config.BackupExpireDays),
+			MarkedAt:   now,
+		})
+		if err != nil {
+			localLogger.Error(err)
+			deleteChannel <- DeleteMessage{
+				TableName:  *backupSummary.TableName,
+				BackupName: *backupSummary.BackupName,
+				Error:      err,
+			}
+			return
+		}
+	}
+
+	deleteAfter, _ := pendingDeletionDue(markedAt, now)
+
+	localLogger.WithFields(logrus.Fields{
+		"markedAt":    markedAt,
+		"deleteAfter": deleteAfter,
+	}).Debug("Backup pending deletion")
+
+	deleteChannel <- DeleteMessage{
+		TableName:  *backupSummary.TableName,
+		BackupName: *backupSummary.BackupName,
+		Pending: &PendingDeletion{
+			TableName:   *backupSummary.TableName,
+			BackupName:  *backupSummary.BackupName,
+			BackupArn:   *backupSummary.BackupArn,
+			MarkedAt:    markedAt,
+			DeleteAfter: deleteAfter,
+		},
+	}
+}
+
+// deleteMarkedBackup deletes a backup whose grace period is over, and then
+// removes its pending deletion mark
+func deleteMarkedBackup(backupSummary *dynamodb.BackupSummary, deleteChannel chan DeleteMessage) {
+	deleteResult := make(chan DeleteMessage, 1)
+	deleteBackup(backupSummary, deleteResult)
+	deleteMessage := <-deleteResult
+
+	if deleteMessage.Error == nil {
+		_, err := clearPendingDeletionMark(*backupSummary.BackupArn)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"backupArn": *backupSummary.BackupArn,
+				"action":    "deleteMarkedBackup",
+			}).Warn(fmt.Sprintf("Deleted backup but could not clear its pending deletion mark: %s", err))
+		}
+	}
+
+	deleteChannel <- deleteMessage
+}
+
+// pendingDeletionDue returns when a backup marked for deletion at markedAt
+// may be deleted, and whether that time has been reached
+func pendingDeletionDue(markedAt time.Time, now time.Time) (time.Time, bool) {
+	deleteAfter := markedAt.AddDate(0, 0, config.BackupDeleteGraceDays)
+	return deleteAfter, !now.Before(deleteAfter)
+}
+
+// getPendingDeletionMark returns the pending deletion record of a backup. Its
+// MarkedAt is the zero time if the backup is not marked.
+func getPendingDeletionMark(backupArn *string) (PendingDeletion, error) {
+	var pending PendingDeletion
+	getItemOutput, err := dynamo.GetItem(&dynamodb.GetItemInput{
+		TableName:      &config.PendingDeletionTable,
+		Key:            pendingDeletionKey(*backupArn),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return pending, err
+	}
+	if len(getItemOutput.Item) == 0 {
+		return pending, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(getItemOutput.Item, &pending)
+	return pending, err
+}
+
+// markPendingDeletion stores a pending deletion mark, unless the backup was
+// already marked by a concurrent run, and returns the time it was marked at
+func markPendingDeletion(pending *PendingDeletion) (time.Time, error) {
+	item, err := dynamodbattribute.MarshalMap(pending)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = dynamo.PutItem(&dynamodb.PutItemInput{
+		TableName:           &config.PendingDeletionTable,
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(backupArn)"),
+	})
+	if isConditionalCheckFailed(err) {
+		existing, err := getPendingDeletionMark(&pending.BackupArn)
+		return existing.MarkedAt, err
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return pending.MarkedAt, nil
+}
+
+// clearPendingDeletionMark removes the mark of a backup, returning whether
+// it was marked
+func clearPendingDeletionMark(backupArn string) (bool, error) {
+	deleteItemOutput, err := dynamo.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:    &config.PendingDeletionTable,
+		Key:          pendingDeletionKey(backupArn),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(deleteItemOutput.Attributes) > 0, nil
+}
+
+func pendingDeletionKey(backupArn string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"backupArn": {S: aws.String(backupArn)},
+	}
+}
+
+// undeleteBackups records the given backups as undeleted, so that they are
+// kept however old they get, until released again with -release. Records are
+// only read while BACKUP_DELETE_GRACE_DAYS is set.
+func undeleteBackups(args []string) {
+	flags := flag.NewFlagSet("undelete", flag.ExitOnError)
+	release := flags.Bool("release", false, "remove the undelete record, so the backups expire again")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("Usage: dynamodb-backups undelete [-release] BACKUP_ARN...")
+	}
+
+	for _, backupArn := range flags.Args() {
+		localLogger := log.WithFields(logrus.Fields{
+			"backupArn": backupArn,
+			"action":    "undeleteBackup",
+		})
+
+		if *release {
+			found, err := clearPendingDeletionMark(backupArn)
+			if err != nil {
+				localLogger.Error(err)
+				continue
+			}
+			if !found {
+				localLogger.Warn("Backup has no undelete record")
+				continue
+			}
+			localLogger.Info("Released backup, it expires again")
+			continue
+		}
+
+		marked, err := recordUndelete(backupArn, time.Now().UTC())
+		if err != nil {
+			localLogger.Error(err)
+			continue
+		}
+		if !marked {
+			localLogger.Info("Backup was not pending deletion, it is kept from now on")
+			continue
+		}
+		localLogger.Info("Cleared pending deletion mark, the backup is kept from now on")
+	}
+}
+
+// recordUndelete stores an undelete record for a backup, replacing any
+// pending deletion mark, and returns whether the backup was marked
+func recordUndelete(backupArn string, now time.Time) (bool, error) {
+	describeBackupOutput, err := dynamo.DescribeBackup(&dynamodb.DescribeBackupInput{
+		BackupArn: &backupArn,
+	})
+	if err != nil {
+		return false, err
+	}
+	backup := describeBackupOutput.BackupDescription
+
+	item, err := dynamodbattribute.MarshalMap(&PendingDeletion{
+		BackupArn:   backupArn,
+		TableName:   aws.StringValue(backup.SourceTableDetails.TableName),
+		BackupName:  aws.StringValue(backup.BackupDetails.BackupName),
+		Reason:      "undeleted",
+		UndeletedAt: &now,
+	})
+	if err != nil {
+		return false, err
+	}
+	delete(item, "markedAt")
+
+	putItemOutput, err := dynamo.PutItem(&dynamodb.PutItemInput{
+		TableName:    &config.PendingDeletionTable,
+		Item:         item,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+	if err != nil {
+		return false, err
+	}
+	_, marked := putItemOutput.Attributes["markedAt"]
+	return marked, nil
+}
+
+// reportPendingDeletions logs the queue of backups waiting out their grace period
+func reportPendingDeletions(pendingQueue []PendingDeletion) {
+	if len(pendingQueue) == 0 {
+		return
+	}
+
+	for _, pending := range pendingQueue {
+		log.WithFields(logrus.Fields{
+			"table":       pending.TableName,
+			"backupName":  pending.BackupName,
+			"backupArn":   pending.BackupArn,
+			"markedAt":    pending.MarkedAt,
+			"deleteAfter": pending.DeleteAfter,
+		}).Info(fmt.Sprintf("Backup %s pending deletion", pending.BackupName))
+	}
+
+	log.WithFields(logrus.Fields{
+		"count":     len(pendingQueue),
+		"graceDays": config.BackupDeleteGraceDays,
+	}).Info(fmt.Sprintf("%d backups pending deletion", len(pendingQueue)))
+}